@@ -0,0 +1,214 @@
+package blocklist
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchTimeout limits download of list from URL
+const fetchTimeout = time.Minute
+
+// List is domain and address list loaded from file or http(s) URL. List keeps
+// previous entries when reload fails. Match methods of nil List match nothing.
+type List struct {
+	Source string
+	// Client fetches URL sources, nil uses http.DefaultClient
+	Client *http.Client
+
+	mu      sync.RWMutex
+	set     *set
+	modTime time.Time
+	etag    string
+}
+
+// Load reads list of source, source starting with http:// or https:// is fetched
+func Load(ctx context.Context, source string, client *http.Client) (*List, error) {
+	l := &List{Source: source, Client: client}
+	if _, err := l.Reload(ctx); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *List) isURL() bool {
+	return strings.HasPrefix(l.Source, "http://") || strings.HasPrefix(l.Source, "https://")
+}
+
+// Reload reads source again when it is changed, by modification time of file
+// or ETag of URL, and reports whether entries were replaced
+func (l *List) Reload(ctx context.Context) (bool, error) {
+	var (
+		parsed  *set
+		modTime time.Time
+		etag    string
+		err     error
+	)
+	if l.isURL() {
+		parsed, etag, err = l.fetch(ctx)
+	} else {
+		parsed, modTime, err = l.read()
+	}
+	if err != nil || parsed == nil {
+		return false, err
+	}
+
+	if parsed.skipped > 0 {
+		slog.Warn("Blocklist lines skipped", "source", l.Source, "skipped", parsed.skipped)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.set, l.modTime, l.etag = parsed, modTime, etag
+
+	return true, nil
+}
+
+// read parses file when its modification time differs from loaded one
+func (l *List) read() (*set, time.Time, error) {
+	info, err := os.Stat(l.Source)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	l.mu.RLock()
+	unchanged := l.set != nil && info.ModTime().Equal(l.modTime)
+	l.mu.RUnlock()
+	if unchanged {
+		return nil, time.Time{}, nil
+	}
+
+	file, err := os.Open(l.Source)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer file.Close()
+
+	parsed, err := parse(file)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %w", l.Source, err)
+	}
+
+	return parsed, info.ModTime(), nil
+}
+
+// fetch downloads list, unchanged list is not downloaded again when server
+// supports ETag
+func (l *List) fetch(ctx context.Context) (*set, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.Source, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	l.mu.RLock()
+	if l.set != nil && l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	l.mu.RUnlock()
+
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, "", nil
+	default:
+		return nil, "", fmt.Errorf("%s: unexpected status %s", l.Source, resp.Status)
+	}
+
+	parsed, err := parse(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", l.Source, err)
+	}
+
+	return parsed, resp.Header.Get("ETag"), nil
+}
+
+func (l *List) current() *set {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.set
+}
+
+// MatchFQDN returns entry matching name or its parent domain
+func (l *List) MatchFQDN(name string) (string, bool) {
+	s := l.current()
+	if s == nil {
+		return "", false
+	}
+
+	return s.matchName(name)
+}
+
+// MatchIP returns entry of range containing ip
+func (l *List) MatchIP(ip net.IP) (string, bool) {
+	s := l.current()
+	addr, ok := netip.AddrFromSlice(ip)
+	if s == nil || !ok {
+		return "", false
+	}
+
+	return s.matchAddr(addr)
+}
+
+// Len returns count of domains and address ranges of list
+func (l *List) Len() int {
+	s := l.current()
+	if s == nil {
+		return 0
+	}
+
+	return s.len()
+}
+
+// Refresh reloads lists every interval until ctx is done, lists failing to
+// reload keep previous entries
+func Refresh(ctx context.Context, lists []*List, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, l := range lists {
+			reloaded, err := l.Reload(ctx)
+			switch {
+			case err != nil:
+				slog.Error("Reload blocklist", "source", l.Source, "err", err)
+			case reloaded:
+				slog.Info("Reload blocklist", "source", l.Source, "entries", l.Len())
+			}
+		}
+	}
+}
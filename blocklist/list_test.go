@@ -0,0 +1,159 @@
+package blocklist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testList = `# hosts file
+127.0.0.1 localhost
+0.0.0.0 ads.example tracker.example # trackers
+! adblock
+||adblock.example^
+||ads.example^$third-party
+@@||allowed.example^
+plain.example
+*.wild.example
+.dot.example
+10.0.0.0/8
+10.1.0.0/16
+192.0.2.0/25
+192.0.2.128/25
+2001:db8::/32
+198.51.100.7
+bad_host!
+`
+
+func TestParse(t *testing.T) {
+	s, err := parse(strings.NewReader(testList))
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, s.skipped)
+	assert.Equal(t, 10, s.len())
+
+	for name, want := range map[string]string{
+		"ads.example":         "ads.example",
+		"ADS.example.":        "ads.example",
+		"adblock.example":     "*.adblock.example",
+		"sub.adblock.example": "*.adblock.example",
+		"plain.example":       "plain.example",
+		"x.wild.example":      "*.wild.example",
+		"dot.example":         "*.dot.example",
+	} {
+		entry, ok := s.matchName(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, want, entry, name)
+	}
+	for _, name := range []string{"sub.ads.example", "sub.plain.example", "localhost", "allowed.example", "example"} {
+		_, ok := s.matchName(name)
+		assert.False(t, ok, name)
+	}
+
+	l := &List{set: s}
+	for ip, want := range map[string]string{
+		"10.1.2.3":        "10.0.0.0/8",
+		"192.0.2.200":     "192.0.2.0-192.0.2.255",
+		"198.51.100.7":    "198.51.100.7/32",
+		"2001:db8::1":     "2001:db8::/32",
+		"::ffff:10.0.0.1": "10.0.0.0/8",
+	} {
+		entry, ok := l.MatchIP(net.ParseIP(ip))
+		assert.True(t, ok, ip)
+		assert.Equal(t, want, entry, ip)
+	}
+	for _, ip := range []string{"11.0.0.1", "198.51.100.8", "2001:db9::1", "0.0.0.0"} {
+		_, ok := l.MatchIP(net.ParseIP(ip))
+		assert.False(t, ok, ip)
+	}
+
+	var nilList *List
+	_, ok := nilList.MatchFQDN("ads.example")
+	assert.False(t, ok)
+}
+
+func TestReloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("ads.example\n"), 0o600))
+
+	l, err := Load(context.Background(), path, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, l.Len())
+
+	reloaded, err := l.Reload(context.Background())
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	require.NoError(t, os.WriteFile(path, []byte("tracker.example\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	reloaded, err = l.Reload(context.Background())
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	_, ok := l.MatchFQDN("tracker.example")
+	assert.True(t, ok)
+
+	// previous entries are kept when file is removed
+	require.NoError(t, os.Remove(path))
+	_, err = l.Reload(context.Background())
+	assert.Error(t, err)
+	_, ok = l.MatchFQDN("tracker.example")
+	assert.True(t, ok)
+
+	_, err = Load(context.Background(), path, nil)
+	assert.Error(t, err)
+}
+
+func TestFetchURL(t *testing.T) {
+	var requests, version atomic.Int32
+	bodies := []string{"||ads.example^\n", "10.0.0.0/8\n"}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requests.Add(1)
+		if request.URL.Path != "/list.txt" {
+			http.NotFound(writer, request)
+			return
+		}
+		current := version.Load()
+		etag := fmt.Sprintf(`"v%d"`, current)
+		if request.Header.Get("If-None-Match") == etag {
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writer.Header().Set("ETag", etag)
+		_, _ = writer.Write([]byte(bodies[current]))
+	}))
+	defer server.Close()
+
+	l, err := Load(context.Background(), server.URL+"/list.txt", server.Client())
+	require.NoError(t, err)
+	entry, ok := l.MatchFQDN("cdn.ads.example")
+	assert.True(t, ok)
+	assert.Equal(t, "*.ads.example", entry)
+
+	reloaded, err := l.Reload(context.Background())
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	version.Store(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Refresh(ctx, []*List{l}, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, ok := l.MatchIP(net.ParseIP("10.0.0.1"))
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, requests.Load(), int32(3))
+
+	_, err = Load(context.Background(), server.URL+"/missing.txt", server.Client())
+	assert.ErrorContains(t, err, "unexpected status 404")
+}
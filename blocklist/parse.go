@@ -0,0 +1,244 @@
+package blocklist
+
+import (
+	"bufio"
+	"cmp"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// set is parsed list, domains are kept in maps and addresses as sorted
+// non-overlapping ranges, so 100k entries take a few megabytes and lookups
+// do not depend on list size
+type set struct {
+	// exact holds domains matching only themselves
+	exact map[string]struct{}
+	// suffix holds domains matching themselves and their subdomains
+	suffix map[string]struct{}
+	ranges []ipRange
+	// skipped is count of lines not recognized by any format
+	skipped int
+}
+
+type ipRange struct {
+	from, to netip.Addr
+	// entry is prefix of list, or from-to when prefixes were merged
+	entry string
+}
+
+// hostsNames are names of hosts files which are not blocked hosts
+var hostsNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+}
+
+// parse reads list of lines in any of supported formats:
+//
+//	0.0.0.0 ads.example tracker.example  hosts file, names match exactly
+//	ads.example                          plain domain, matches exactly
+//	*.ads.example or .ads.example        domain with subdomains
+//	||ads.example^                       adblock rule, domain with subdomains
+//	10.0.0.0/8 or 192.0.2.1              CIDR or IP address
+//
+// Lines starting with #, ! or [ are comments, adblock exceptions and rules
+// with options are skipped as they can not be applied to destination name.
+func parse(reader io.Reader) (*set, error) {
+	s := &set{exact: make(map[string]struct{}), suffix: make(map[string]struct{})}
+	var prefixes []netip.Prefix
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		if rule, ok := strings.CutPrefix(line, "||"); ok {
+			domain, ok := strings.CutSuffix(rule, "^")
+			if !ok || !s.add(s.suffix, domain) {
+				s.skipped++
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			if _, err := netip.ParseAddr(fields[0]); err != nil {
+				s.skipped++
+				continue
+			}
+			for _, name := range fields[1:] {
+				if !hostsNames[strings.ToLower(name)] && !s.add(s.exact, name) {
+					s.skipped++
+				}
+			}
+			continue
+		}
+
+		if prefix, ok := parsePrefix(line); ok {
+			prefixes = append(prefixes, prefix)
+			continue
+		}
+
+		var added bool
+		if domain, ok := strings.CutPrefix(line, "*."); ok {
+			added = s.add(s.suffix, domain)
+		} else if domain, ok := strings.CutPrefix(line, "."); ok {
+			added = s.add(s.suffix, domain)
+		} else {
+			added = s.add(s.exact, line)
+		}
+		if !added {
+			s.skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	s.ranges = mergePrefixes(prefixes)
+
+	return s, nil
+}
+
+// add puts valid domain name to domains of set
+func (s *set) add(domains map[string]struct{}, name string) bool {
+	name = normalize(name)
+	if !validName(name) {
+		return false
+	}
+
+	domains[name] = struct{}{}
+
+	return true
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// validName checks name as dot separated labels of letters, digits,
+// hyphens and underscores
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for label := range strings.SplitSeq(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// parsePrefix parses CIDR or single IP address as /32 or /128 prefix
+func parsePrefix(text string) (netip.Prefix, bool) {
+	if strings.Contains(text, "/") {
+		prefix, err := netip.ParsePrefix(text)
+		return prefix.Masked(), err == nil
+	}
+
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), true
+}
+
+// lastAddr returns last address of prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 1 << (7 - bit%8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+
+	return addr
+}
+
+// mergePrefixes sorts prefixes into ranges, overlapping and adjacent
+// prefixes are merged into single range
+func mergePrefixes(prefixes []netip.Prefix) []ipRange {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return cmp.Or(a.Addr().Compare(b.Addr()), cmp.Compare(a.Bits(), b.Bits()))
+	})
+
+	var ranges []ipRange
+	for _, prefix := range prefixes {
+		current := ipRange{from: prefix.Addr(), to: lastAddr(prefix), entry: prefix.String()}
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			if last.to.Is4() == current.from.Is4() && (last.to.Compare(current.from) >= 0 || last.to.Next() == current.from) {
+				if current.to.Compare(last.to) > 0 {
+					last.to = current.to
+					last.entry = last.from.String() + "-" + last.to.String()
+				}
+				continue
+			}
+		}
+		ranges = append(ranges, current)
+	}
+
+	return ranges
+}
+
+// matchName returns domain of set matching name or its parent domain
+func (s *set) matchName(name string) (string, bool) {
+	name = normalize(name)
+	if _, ok := s.exact[name]; ok {
+		return name, true
+	}
+
+	for domain := name; ; {
+		if _, ok := s.suffix[domain]; ok {
+			return "*." + domain, true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return "", false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// matchAddr returns entry of range containing addr
+func (s *set) matchAddr(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	i, _ := slices.BinarySearchFunc(s.ranges, addr, func(r ipRange, addr netip.Addr) int {
+		switch {
+		case r.to.Compare(addr) < 0:
+			return -1
+		case r.from.Compare(addr) > 0:
+			return 1
+		}
+		return 0
+	})
+	if i < len(s.ranges) && s.ranges[i].from.Compare(addr) <= 0 && s.ranges[i].to.Compare(addr) >= 0 {
+		return s.ranges[i].entry, true
+	}
+
+	return "", false
+}
+
+// len returns count of domains and address ranges of set
+func (s *set) len() int {
+	return len(s.exact) + len(s.suffix) + len(s.ranges)
+}
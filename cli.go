@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"rgosocks/config"
+	"rgosocks/proxy"
+	"rgosocks/stat"
+	"rgosocks/version"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Exit codes of commands, test-rule exits as grep does: 0 - allowed,
+// 1 - denied, 2 - request could not be checked
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitDenied    = 1
+	exitRuleError = 2
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+func commands() []command {
+	return []command{
+		{"serve", "Start proxy servers (default command)", serve},
+		{"version", "Print version information", printVersion},
+		{"check-config", "Validate config file and print effective configuration", checkConfig},
+		{"hash-password", "Read password from stdin and print bcrypt hash for PROXY_USERS_FILE", hashPassword},
+		{"test-rule", "Check whether request to host:port is allowed by rules", testRule},
+		{"status", "Query status server of running instance", queryStatus},
+	}
+}
+
+func usage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Usage: rgosocks5 [command] [flags]\n\nCommands:\n")
+	for _, c := range commands() {
+		_, _ = fmt.Fprintf(w, "  %-14s %s\n", c.name, c.summary)
+	}
+	_, _ = fmt.Fprintf(w, "\nRun 'rgosocks5 <command> -h' for flags of command.\n")
+}
+
+// run executes command of args, flags without command are flags of serve
+func run(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "-help" && args[0] != "--help" {
+		return serve(args)
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return exitOK
+	}
+
+	for _, c := range commands() {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	usage(os.Stderr)
+
+	return exitUsage
+}
+
+func newFlagSet(name, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(flags.Output(), "Usage: rgosocks5 %s [flags] %s\n", name, arguments)
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+// configFlag adds flag of config file, CONFIG_FILE variable is default
+func configFlag(flags *flag.FlagSet) *string {
+	return flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config `file`")
+}
+
+// loadConfig loads and validates config of file and environment
+func loadConfig(path string) error {
+	if err := config.Load(path); err != nil {
+		return err
+	}
+
+	return config.Validate()
+}
+
+func serve(args []string) int {
+	flags := newFlagSet("serve", "")
+	configFile := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	ver, commit, date, goVer, arch := version.Info()
+	slog.Info("Version", "version", ver, "commit", commit, "date", date, "go", goVer, "arch", arch)
+	if err := loadConfig(*configFile); err != nil {
+		slog.Error("Config", "err", err)
+		return exitError
+	}
+
+	if config.Cfg.LogLevelDebug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	slog.Debug("Config", "env", config.Cfg)
+
+	statusServer := stat.NewStat(
+		config.Cfg.StatusEnabled,
+		config.Cfg.StatusAddress,
+		config.Cfg.StatusBearer,
+	)
+
+	go startProxy(statusServer)
+
+	sigs := make(chan os.Signal, 1)
+
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+	slog.Debug("Signal", "sig", sig.String())
+
+	return exitOK
+}
+
+type versionInfo struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+	Go      string `json:"go"`
+	Arch    string `json:"arch"`
+}
+
+func printVersion(args []string) int {
+	flags := newFlagSet("version", "")
+	format := flags.String("format", "text", "output `format`: text or json")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	var info versionInfo
+	info.Version, info.Commit, info.Date, info.Go, info.Arch = version.Info()
+
+	switch *format {
+	case "text":
+		fmt.Printf("version: %s\ncommit: %s\ndate: %s\ngo: %s\narch: %s\n",
+			info.Version, info.Commit, info.Date, info.Go, info.Arch)
+	case "json":
+		data, _ := json.Marshal(info)
+		fmt.Println(string(data))
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown format %q\n", *format)
+		return exitUsage
+	}
+
+	return exitOK
+}
+
+// checkConfig validates config file and prints effective configuration with
+// secrets redacted, file may be given as argument instead of flag
+func checkConfig(args []string) int {
+	flags := newFlagSet("check-config", "[file]")
+	configFile := configFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		*configFile = flags.Arg(0)
+	}
+
+	if err := loadConfig(*configFile); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	data, err := config.Redacted()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	_, _ = os.Stdout.Write(data)
+
+	return exitOK
+}
+
+// hashPassword reads password from first line of stdin, so it is not kept in shell history
+func hashPassword(args []string) int {
+	flags := newFlagSet("hash-password", "< password")
+	user := flags.String("user", "", "print `name`:hash line of users file")
+	cost := flags.Int("cost", bcrypt.DefaultCost, "bcrypt `cost`")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "Empty password")
+		return exitError
+	}
+
+	hash, err := proxy.HashPassword(password, *cost)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	if *user != "" {
+		fmt.Printf("%s:%s\n", *user, hash)
+	} else {
+		fmt.Println(hash)
+	}
+
+	return exitOK
+}
+
+// testRule evaluates request of user to destination by rules of listener as proxy does
+func testRule(args []string) int {
+	flags := newFlagSet("test-rule", "host:port")
+	configFile := configFlag(flags)
+	listenerIndex := flags.Int("listener", -1, "`index` of PROXY_LISTENER_<n> whose rules are used, -1 uses main listener")
+	user := flags.String("user", "", "username of request")
+	commandName := flags.String("command", "connect", "socks5 `command`: connect, bind or associate")
+	resolve := flags.Bool("resolve", true, "resolve host by configured DNS before checking IP rules")
+	trace := flags.Bool("trace", false, "print evaluation of every rule")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	command, ok := proxy.Commands[*commandName]
+	if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown command %q\n", *commandName)
+		return exitUsage
+	}
+
+	dest, err := proxy.ParseDest(flags.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if err := loadConfig(*configFile); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitRuleError
+	}
+
+	listener := config.Listener{}
+	if *listenerIndex >= 0 {
+		if *listenerIndex >= len(config.Cfg.Listeners) {
+			_, _ = fmt.Fprintf(os.Stderr, "Listener %d is not configured\n", *listenerIndex)
+			return exitRuleError
+		}
+		listener = config.Cfg.Listeners[*listenerIndex]
+	}
+
+	handler := &proxy.Handler{Rules: newRules(listener, loadRuleData())}
+	if *resolve {
+		handler.Resolver = newResolver()
+	}
+	req := proxy.NewRequest(command, dest, *user, &net.TCPAddr{}, &net.TCPAddr{})
+	decision, resolveErr := handler.Explain(context.Background(), req)
+
+	target := flags.Arg(0)
+	if req.DestAddr.FQDN != "" && req.DestAddr.IP != nil {
+		target += " (" + req.DestAddr.IP.String() + ")"
+	}
+
+	result, code := "allowed", exitOK
+	switch {
+	case decision.Audited:
+		result = "allowed by audit mode"
+	case !decision.Allowed:
+		result, code = "denied", exitDenied
+	case resolveErr != nil:
+		// FQDN rules allow request, but proxy can not connect to it
+		_, _ = fmt.Fprintln(os.Stderr, resolveErr)
+		return exitRuleError
+	}
+
+	if decision.Country != "" || decision.ASN != 0 {
+		target += fmt.Sprintf(" [country=%s asn=%d]", decision.Country, decision.ASN)
+	}
+	if decision.Parent != nil {
+		target += " via " + decision.Parent.Redacted()
+	}
+	if decision.Egress != nil {
+		target += " from " + decision.Egress.String()
+	}
+
+	fmt.Printf("%s: %s %s: %s\n", result, *commandName, target, decision)
+	if *trace {
+		for _, step := range decision.Trace {
+			fmt.Printf("  %-18s entries=%d match=%t", step.Rule, step.Entries, step.Match)
+			if step.Entry != "" {
+				fmt.Printf(" entry=%s", step.Entry)
+			}
+			if step.Source != "" {
+				fmt.Printf(" source=%s", step.Source)
+			}
+			if step.Skipped {
+				fmt.Print(" skipped")
+			}
+			fmt.Println()
+		}
+	}
+
+	return code
+}
+
+// queryStatus prints response of status server endpoint, /status by default
+func queryStatus(args []string) int {
+	flags := newFlagSet("status", "[path]")
+	configFile := configFlag(flags)
+	address := flags.String("address", "", "`address` of status server, default is STATUS_ADDRESS")
+	token := flags.String("token", "", "auth `token` of status server, default is STATUS_TOKEN")
+	timeout := flags.Duration("timeout", 5*time.Second, "request timeout")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if err := loadConfig(*configFile); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if *address == "" {
+		*address = statusClientAddress(config.Cfg.StatusAddress)
+	}
+	if *token == "" {
+		*token = config.Cfg.StatusBearer
+	}
+
+	path := "/status"
+	if flags.NArg() > 0 {
+		path = "/" + strings.TrimPrefix(flags.Arg(0), "/")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+*address+path, nil)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := (&http.Client{Timeout: *timeout}).Do(req)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, _ = fmt.Fprintf(os.Stderr, "Status server responded %s\n", resp.Status)
+		return exitError
+	}
+
+	var out bytes.Buffer
+	if json.Indent(&out, body, "", "  ") != nil {
+		out.Reset()
+		out.Write(body)
+	}
+	fmt.Println(strings.TrimSpace(out.String()))
+
+	return exitOK
+}
+
+// statusClientAddress replaces unspecified listen host of status server by loopback
+func statusClientAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
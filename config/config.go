@@ -1,39 +1,142 @@
 package config
 
 import (
-	"github.com/caarlos0/env/v11"
 	"log"
+	"os"
+	"time"
 )
 
 type Config struct {
 	ProxyHost        string   `env:"PROXY_HOST" envDefault:"0.0.0.0"`
 	ProxyPort        int      `env:"PROXY_PORT" envDefault:"1080"`
 	ProxyUser        string   `env:"PROXY_USER" envDefault:""`
-	ProxyPassword    string   `env:"PROXY_PASS" envDefault:""`
-	ProxyAddress     string   `env:"PROXY_ADDRESS,expand" envDefault:"$PROXY_HOST:$PROXY_PORT"`
-	AllowedDestFQDN  []string `env:"PROXY_ALLOWED_DEST_FQDN" envDefault:""`
-	RejectDestFQDN   []string `env:"PROXY_REJECT_DEST_FQDN" envDefault:""`
-	AllowedIPs       []string `env:"PROXY_ALLOWED_IPS" envDefault:""`
-	RejectIPs        []string `env:"PROXY_REJECT_IPS" envDefault:""`
+	ProxyPassword    string   `env:"PROXY_PASS" envDefault:"" redact:"true"`
+	UsersFile        string   `env:"PROXY_USERS_FILE" envDefault:""`
+	ProxyAddress     string   `env:"PROXY_ADDRESS,expand" envDefault:"$PROXY_HOST:$PROXY_PORT" validate:"address"`
+	AllowedDestFQDN  []string `env:"PROXY_ALLOWED_DEST_FQDN" envDefault:"" validate:"fqdn"`
+	RejectDestFQDN   []string `env:"PROXY_REJECT_DEST_FQDN" envDefault:"" validate:"fqdn"`
+	AllowedIPs       []string `env:"PROXY_ALLOWED_IPS" envDefault:"" validate:"cidr"`
+	RejectIPs        []string `env:"PROXY_REJECT_IPS" envDefault:"" validate:"cidr"`
+	GeoipDatabases   []string `env:"PROXY_GEOIP_DB" envDefault:""`
+	AllowedCountries []string `env:"PROXY_ALLOWED_COUNTRIES" envDefault:"" validate:"country"`
+	RejectCountries  []string `env:"PROXY_REJECT_COUNTRIES" envDefault:"" validate:"country"`
+	AllowedASNs      []string `env:"PROXY_ALLOWED_ASNS" envDefault:"" validate:"asn"`
+	RejectASNs       []string `env:"PROXY_REJECT_ASNS" envDefault:"" validate:"asn"`
 	DisableBind      bool     `env:"PROXY_DISABLE_BIND" envDefault:"false"`
 	DisableAssociate bool     `env:"PROXY_DISABLE_ASSOCIATE" envDefault:"false"`
+	RulesAudit       bool     `env:"PROXY_RULES_AUDIT" envDefault:"false"`
+	RulesScript      string   `env:"PROXY_RULES_SCRIPT" envDefault:"" validate:"script"`
+	ProxyHttpAddress string   `env:"PROXY_HTTP_ADDRESS" envDefault:"" validate:"address"`
+	ProxyHttpSniff   bool     `env:"PROXY_HTTP_SNIFF" envDefault:"false"`
+	DisableSocks4    bool     `env:"PROXY_DISABLE_SOCKS4" envDefault:"false"`
+	Socks4CheckUser  bool     `env:"PROXY_SOCKS4_CHECK_USERID" envDefault:"true"`
+	ProxyTlsAddress  string   `env:"PROXY_TLS_ADDRESS" envDefault:"" validate:"address"`
+	ProxyTlsCert     string   `env:"PROXY_TLS_CERT" envDefault:""`
+	ProxyTlsKey      string   `env:"PROXY_TLS_KEY" envDefault:""`
 	DnsHost          string   `env:"DNS_HOST" envDefault:""`
 	DnsPort          int      `env:"DNS_PORT" envDefault:"53"`
 	DnsUseCache      bool     `env:"DNS_USE_CACHE" envDefault:"true"`
 	PreferIpv6       bool     `env:"PREFER_IPV6" envDefault:"false"`
 	LogLevelDebug    bool     `env:"LOG_LEVEL_DEBUG" envDefault:"false"`
 
+	DnsTimeout         time.Duration `env:"DNS_TIMEOUT" envDefault:"5s"`
+	DnsSystemTtl       time.Duration `env:"DNS_SYSTEM_TTL" envDefault:"1m"`
+	DnsDnssec          string        `env:"DNS_DNSSEC" envDefault:"off" validate:"oneof=off|ad|validate"`
+	DnsTrustAnchor     string        `env:"DNS_DNSSEC_TRUST_ANCHOR" envDefault:""`
+	DnsCacheMaxEntries int           `env:"DNS_CACHE_MAX_ENTRIES" envDefault:"10000"`
+	DnsCacheMinTtl     time.Duration `env:"DNS_CACHE_MIN_TTL" envDefault:"0s"`
+	DnsCacheMaxTtl     time.Duration `env:"DNS_CACHE_MAX_TTL" envDefault:"24h"`
+	DnsCacheNegative   bool          `env:"DNS_CACHE_NEGATIVE" envDefault:"true"`
+	DnsCachePrefetch   bool          `env:"DNS_CACHE_PREFETCH" envDefault:"true"`
+	DnsCacheStaleTtl   time.Duration `env:"DNS_CACHE_STALE_TTL" envDefault:"1h"`
+
+	EgressAddress      string        `env:"PROXY_EGRESS_ADDRESS" envDefault:"" validate:"ip"`
+	ProxyProtocol      []string      `env:"PROXY_PROTOCOL_TRUSTED" envDefault:"" validate:"cidr"`
+	Listeners          []Listener    `envPrefix:"PROXY_LISTENER"`
+	Forwards           []Forward     `envPrefix:"PROXY_FORWARD"`
+	Schedules          []Schedule    `envPrefix:"PROXY_SCHEDULE"`
+	TransparentAddress string        `env:"PROXY_TRANSPARENT_ADDRESS" envDefault:"" validate:"address"`
+	TransparentMode    string        `env:"PROXY_TRANSPARENT_MODE" envDefault:"redirect" validate:"oneof=redirect|tproxy"`
+	TransparentSniff   bool          `env:"PROXY_TRANSPARENT_SNIFF" envDefault:"true"`
+	SniffTimeout       time.Duration `env:"PROXY_SNIFF_TIMEOUT" envDefault:"1s"`
+	SniffRules         bool          `env:"PROXY_SNIFF_RULES" envDefault:"false"`
+
+	AllowedLists []string      `env:"PROXY_ALLOWED_LISTS" envDefault:"" redact:"url"`
+	RejectLists  []string      `env:"PROXY_REJECT_LISTS" envDefault:"" redact:"url"`
+	ListsRefresh time.Duration `env:"PROXY_LISTS_REFRESH" envDefault:"1h"`
+
+	PolicyURL      string        `env:"PROXY_POLICY_URL" envDefault:"" validate:"url"`
+	PolicyToken    string        `env:"PROXY_POLICY_TOKEN" envDefault:"" redact:"true"`
+	PolicyTimeout  time.Duration `env:"PROXY_POLICY_TIMEOUT" envDefault:"1s"`
+	PolicyCacheTtl time.Duration `env:"PROXY_POLICY_CACHE_TTL" envDefault:"1m"`
+	PolicyFailOpen bool          `env:"PROXY_POLICY_FAIL_OPEN" envDefault:"false"`
+
+	UdpPortMin      int           `env:"PROXY_UDP_PORT_MIN" envDefault:"0"`
+	UdpPortMax      int           `env:"PROXY_UDP_PORT_MAX" envDefault:"0"`
+	UdpIdleTimeout  time.Duration `env:"PROXY_UDP_IDLE_TIMEOUT" envDefault:"2m"`
+	UdpMaxTargets   int           `env:"PROXY_UDP_MAX_TARGETS" envDefault:"64"`
+	UdpAllowedUsers []string      `env:"PROXY_UDP_ALLOWED_USERS" envDefault:""`
+	UdpDeniedUsers  []string      `env:"PROXY_UDP_DENIED_USERS" envDefault:""`
+
+	BindPortMin       int           `env:"PROXY_BIND_PORT_MIN" envDefault:"0"`
+	BindPortMax       int           `env:"PROXY_BIND_PORT_MAX" envDefault:"0"`
+	BindExternalIP    string        `env:"PROXY_BIND_EXTERNAL_IP" envDefault:"" validate:"ip"`
+	BindAcceptTimeout time.Duration `env:"PROXY_BIND_ACCEPT_TIMEOUT" envDefault:"2m"`
+	BindAllowedPeers  []string      `env:"PROXY_BIND_ALLOWED_PEERS" envDefault:"" validate:"cidr"`
+
+	TlsClientCa   string `env:"PROXY_TLS_CLIENT_CA" envDefault:""`
+	TlsClientCrl  string `env:"PROXY_TLS_CLIENT_CRL" envDefault:""`
+	TlsClientUser string `env:"PROXY_TLS_CLIENT_USER" envDefault:"cn" validate:"oneof=cn|email|dns|uri"`
+
 	StatusEnabled bool   `env:"STATUS_ENABLED" envDefault:"false"`
 	StatusHost    string `env:"STATUS_HOST" envDefault:"0.0.0.0"`
 	StatusPort    int    `env:"STATUS_PORT" envDefault:"2080"`
-	StatusAddress string `env:"STATUS_ADDRESS,expand" envDefault:"$STATUS_HOST:$STATUS_PORT"`
-	StatusBearer  string `env:"STATUS_TOKEN" envDefault:""`
+	StatusAddress string `env:"STATUS_ADDRESS,expand" envDefault:"$STATUS_HOST:$STATUS_PORT" validate:"address"`
+	StatusBearer  string `env:"STATUS_TOKEN" envDefault:"" redact:"true"`
+}
+
+// Listener is additional proxy listener configured by PROXY_LISTENER_<n>_*
+// variables. Listener without own credentials or rules inherits global ones.
+type Listener struct {
+	Network         string   `env:"NETWORK" envDefault:"tcp" validate:"oneof=tcp|tcp4|tcp6|unix"`
+	Address         string   `env:"ADDRESS"`
+	User            string   `env:"USER"`
+	Password        string   `env:"PASS" redact:"true"`
+	NoAuth          bool     `env:"NO_AUTH" envDefault:"false"`
+	AllowedDestFQDN []string `env:"ALLOWED_DEST_FQDN" validate:"fqdn"`
+	RejectDestFQDN  []string `env:"REJECT_DEST_FQDN" validate:"fqdn"`
+	AllowedIPs      []string `env:"ALLOWED_IPS" validate:"cidr"`
+	RejectIPs       []string `env:"REJECT_IPS" validate:"cidr"`
+	EgressAddress   string   `env:"EGRESS_ADDRESS" validate:"ip"`
+	HttpSniff       bool     `env:"HTTP_SNIFF" envDefault:"false"`
+	ProxyProtocol   []string `env:"PROXY_PROTOCOL_TRUSTED" validate:"cidr"`
+}
+
+// Forward is static tunnel configured by PROXY_FORWARD_<n>_* variables
+type Forward struct {
+	Listen string `env:"LISTEN" validate:"address"`
+	Target string `env:"TARGET" validate:"address"`
+	Parent string `env:"PARENT" redact:"url" validate:"url"`
+}
+
+// Schedule limits users to days and hours configured by PROXY_SCHEDULE_<n>_* variables
+type Schedule struct {
+	Users    []string `env:"USERS"`
+	Days     []string `env:"DAYS" validate:"days"`
+	Hours    []string `env:"HOURS" validate:"hours"`
+	Timezone string   `env:"TIMEZONE" envDefault:"UTC" validate:"timezone"`
+	Cut      bool     `env:"CUT" envDefault:"false"`
 }
 
 var Cfg = Config{}
 
+// Parse loads configuration from file of CONFIG_FILE variable and environment
 func Parse() {
-	if err := env.Parse(&Cfg); err != nil {
+	if err := Load(os.Getenv("CONFIG_FILE")); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := Validate(); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -27,3 +27,25 @@ func TestParse(t *testing.T) {
 		t.Errorf("Parse() = %v, want %v", Cfg.LogLevelDebug, true)
 	}
 }
+
+func TestParseListeners(t *testing.T) {
+	t.Setenv("PROXY_LISTENER_0_ADDRESS", "127.0.0.1:1081")
+	t.Setenv("PROXY_LISTENER_0_NO_AUTH", "true")
+	t.Setenv("PROXY_LISTENER_1_NETWORK", "unix")
+	t.Setenv("PROXY_LISTENER_1_ADDRESS", "/run/rgosocks.sock")
+	t.Setenv("PROXY_LISTENER_1_ALLOWED_IPS", "10.0.0.0/8,192.168.0.1")
+
+	Parse()
+
+	if len(Cfg.Listeners) != 2 {
+		t.Fatalf("Parse() = %d listeners, want %d", len(Cfg.Listeners), 2)
+	}
+
+	if l := Cfg.Listeners[0]; l.Network != "tcp" || l.Address != "127.0.0.1:1081" || !l.NoAuth {
+		t.Errorf("Parse() = %+v, want tcp 127.0.0.1:1081 without auth", l)
+	}
+
+	if l := Cfg.Listeners[1]; l.Network != "unix" || len(l.AllowedIPs) != 2 || l.NoAuth {
+		t.Errorf("Parse() = %+v, want unix with 2 allowed IPs", l)
+	}
+}
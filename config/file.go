@@ -0,0 +1,470 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+	"gopkg.in/yaml.v3"
+)
+
+// fileNode is value of YAML or TOML config file with its line
+type fileNode struct {
+	line int
+	// scalar is string, bool, int64, float64 or nil
+	scalar any
+	list   []*fileNode
+	table  []fileEntry
+	kind   fileKind
+}
+
+type fileKind int
+
+const (
+	fileScalar fileKind = iota
+	fileList
+	fileTable
+)
+
+type fileEntry struct {
+	key   string
+	line  int
+	value *fileNode
+}
+
+// setting describes field of Config in file and environment
+type setting struct {
+	env   string
+	key   string
+	index int
+	typ   reflect.Type
+	// items describes fields of list elements like listeners
+	items []setting
+	tag   reflect.StructTag
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// schema lists settings of struct type t, key in file is env name in lower case
+func schema(t reflect.Type) []setting {
+	var settings []setting
+	for i := range t.NumField() {
+		field := t.Field(i)
+		s := setting{index: i, typ: field.Type, tag: field.Tag}
+		if prefix, ok := field.Tag.Lookup("envPrefix"); ok {
+			s.env = prefix
+			s.items = schema(field.Type.Elem())
+		} else if name, ok := field.Tag.Lookup("env"); ok {
+			s.env, _, _ = strings.Cut(name, ",")
+		} else {
+			continue
+		}
+		s.key = strings.ToLower(s.env)
+		settings = append(settings, s)
+	}
+
+	return settings
+}
+
+// origins maps env names of loaded settings to their location in file,
+// settings from environment are not listed
+var origins map[string]string
+
+// origin returns location of setting for error messages
+func origin(env string) string {
+	if location, ok := origins[env]; ok {
+		return location + ": " + env
+	}
+
+	return env
+}
+
+// Load reads configuration from YAML or TOML file and environment into Cfg,
+// environment variables override file. Empty path loads environment only.
+func Load(path string) error {
+	environment := make(map[string]string)
+	locations := make(map[string]string)
+
+	if path != "" {
+		root, err := readFile(path)
+		if err != nil {
+			return err
+		}
+
+		if err := fileEnvironment(path, root, schema(reflect.TypeFor[Config]()), "", environment, locations); err != nil {
+			return err
+		}
+	}
+
+	for _, variable := range os.Environ() {
+		if name, value, ok := strings.Cut(variable, "="); ok {
+			environment[name] = value
+			delete(locations, name)
+		}
+	}
+
+	cfg := Config{}
+	if err := parseEnv(&cfg, environment); err != nil {
+		return err
+	}
+
+	Cfg = cfg
+	origins = locations
+
+	return nil
+}
+
+func readFile(path string) (*fileNode, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return parseYAML(path, data)
+	case ".toml":
+		return parseTOML(path, data)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, use .yaml, .yml or .toml", path)
+	}
+}
+
+func parseYAML(path string, data []byte) (*fileNode, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(document.Content) == 0 {
+		return &fileNode{kind: fileTable}, nil
+	}
+
+	return yamlNode(document.Content[0]), nil
+}
+
+func yamlNode(node *yaml.Node) *fileNode {
+	result := &fileNode{line: node.Line}
+
+	switch node.Kind {
+	case yaml.AliasNode:
+		return yamlNode(node.Alias)
+	case yaml.MappingNode:
+		result.kind = fileTable
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			result.table = append(result.table, fileEntry{key: key.Value, line: key.Line, value: yamlNode(node.Content[i+1])})
+		}
+	case yaml.SequenceNode:
+		result.kind = fileList
+		for _, item := range node.Content {
+			result.list = append(result.list, yamlNode(item))
+		}
+	default:
+		result.scalar = node.Value
+		switch node.ShortTag() {
+		case "!!null":
+			result.scalar = nil
+		case "!!bool":
+			_ = node.Decode(&result.scalar)
+		case "!!int":
+			var value int64
+			if node.Decode(&value) == nil {
+				result.scalar = value
+			}
+		case "!!float":
+			var value float64
+			if node.Decode(&value) == nil {
+				result.scalar = value
+			}
+		}
+	}
+
+	return result
+}
+
+// parseTOML supports top level keys and arrays of tables for lists like listeners
+func parseTOML(path string, data []byte) (*fileNode, error) {
+	parser := unstable.Parser{}
+	parser.Reset(data)
+
+	line := func(node *unstable.Node) int {
+		return parser.Shape(node.Raw).Start.Line
+	}
+	tomlKey := func(node *unstable.Node) (string, int) {
+		var parts []string
+		first := 0
+		for it := node.Key(); it.Next(); {
+			if first == 0 {
+				first = line(it.Node())
+			}
+			parts = append(parts, string(it.Node().Data))
+		}
+		return strings.Join(parts, "."), first
+	}
+
+	root := &fileNode{kind: fileTable, line: 1}
+	current := root
+	for parser.NextExpression() {
+		expr := parser.Expression()
+		switch expr.Kind {
+		case unstable.KeyValue:
+			key, keyLine := tomlKey(expr)
+			value, err := tomlValue(&parser, expr.Value())
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %w", path, keyLine, key, err)
+			}
+			current.table = append(current.table, fileEntry{key: key, line: keyLine, value: value})
+		case unstable.Table:
+			key, keyLine := tomlKey(expr)
+			current = &fileNode{kind: fileTable, line: keyLine}
+			root.table = append(root.table, fileEntry{key: key, line: keyLine, value: current})
+		case unstable.ArrayTable:
+			key, keyLine := tomlKey(expr)
+			current = &fileNode{kind: fileTable, line: keyLine}
+			var list *fileNode
+			for _, entry := range root.table {
+				if entry.key == key && entry.value.kind == fileList {
+					list = entry.value
+				}
+			}
+			if list == nil {
+				list = &fileNode{kind: fileList, line: keyLine}
+				root.table = append(root.table, fileEntry{key: key, line: keyLine, value: list})
+			}
+			list.list = append(list.list, current)
+		}
+	}
+
+	if err := parser.Error(); err != nil {
+		var parserErr *unstable.ParserError
+		if errors.As(err, &parserErr) {
+			shape := parser.Shape(parser.Range(parserErr.Highlight))
+			return nil, fmt.Errorf("%s:%d: %s", path, shape.Start.Line, parserErr.Message)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return root, nil
+}
+
+func tomlValue(parser *unstable.Parser, node *unstable.Node) (*fileNode, error) {
+	result := &fileNode{line: parser.Shape(node.Raw).Start.Line}
+	data := string(node.Data)
+
+	switch node.Kind {
+	case unstable.String:
+		result.scalar = data
+	case unstable.Bool:
+		result.scalar = data == "true"
+	case unstable.Integer:
+		value, err := strconv.ParseInt(strings.ReplaceAll(data, "_", ""), 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		result.scalar = value
+	case unstable.Float:
+		value, err := strconv.ParseFloat(strings.ReplaceAll(data, "_", ""), 64)
+		if err != nil {
+			return nil, err
+		}
+		result.scalar = value
+	case unstable.Array:
+		result.kind = fileList
+		for it := node.Children(); it.Next(); {
+			item, err := tomlValue(parser, it.Node())
+			if err != nil {
+				return nil, err
+			}
+			result.list = append(result.list, item)
+		}
+	case unstable.InlineTable:
+		result.kind = fileTable
+		for it := node.Children(); it.Next(); {
+			child := it.Node()
+			var parts []string
+			for key := child.Key(); key.Next(); {
+				parts = append(parts, string(key.Node().Data))
+			}
+			value, err := tomlValue(parser, child.Value())
+			if err != nil {
+				return nil, err
+			}
+			result.table = append(result.table, fileEntry{key: strings.Join(parts, "."), line: value.line, value: value})
+		}
+	default:
+		// dates are kept as text
+		result.scalar = data
+	}
+
+	return result, nil
+}
+
+// fileEnvironment converts table of file to env variables of settings,
+// all schema errors of file are returned together
+func fileEnvironment(path string, table *fileNode, settings []setting, prefix string,
+	environment map[string]string, locations map[string]string) error {
+	if table.kind != fileTable {
+		return fmt.Errorf("%s:%d: expected table of settings", path, table.line)
+	}
+
+	var errs []error
+	seen := make(map[string]int)
+	for _, entry := range table.table {
+		index := -1
+		for i := range settings {
+			if settings[i].key == entry.key {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown setting %q", path, entry.line, entry.key))
+			continue
+		}
+		if line, ok := seen[entry.key]; ok {
+			errs = append(errs, fmt.Errorf("%s:%d: setting %q is already defined on line %d", path, entry.line, entry.key, line))
+			continue
+		}
+		seen[entry.key] = entry.line
+
+		s := settings[index]
+		name := prefix + s.env
+		if s.items != nil {
+			if entry.value.kind != fileList {
+				errs = append(errs, fmt.Errorf("%s:%d: %s: expected list of tables", path, entry.line, entry.key))
+				continue
+			}
+			for i, item := range entry.value.list {
+				itemPrefix := fmt.Sprintf("%s_%d_", name, i)
+				if err := fileEnvironment(path, item, s.items, itemPrefix, environment, locations); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			continue
+		}
+
+		value, err := envValue(s.typ, entry.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %w", path, entry.value.line, entry.key, err))
+			continue
+		}
+		environment[name] = value
+		locations[name] = fmt.Sprintf("%s:%d", path, entry.line)
+	}
+
+	return errors.Join(errs...)
+}
+
+// envValue formats file value as env variable of type typ
+func envValue(typ reflect.Type, node *fileNode) (string, error) {
+	if typ.Kind() == reflect.Slice {
+		if node.kind != fileList {
+			return "", errors.New("expected list")
+		}
+		values := make([]string, 0, len(node.list))
+		for _, item := range node.list {
+			value, err := envValue(typ.Elem(), item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(value, ",") {
+				return "", fmt.Errorf("list item %q contains comma", value)
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	}
+
+	if node.kind != fileScalar {
+		return "", errors.New("expected single value")
+	}
+
+	switch value := node.scalar.(type) {
+	case nil:
+		return "", nil
+	case bool:
+		if typ.Kind() == reflect.Bool || typ.Kind() == reflect.String {
+			return strconv.FormatBool(value), nil
+		}
+	case int64:
+		if typ == durationType {
+			if value == 0 {
+				return "0s", nil
+			}
+			return "", errors.New("expected duration like 5s, 1m or 2h")
+		}
+		if typ.Kind() == reflect.Int || typ.Kind() == reflect.String {
+			return strconv.FormatInt(value, 10), nil
+		}
+	case float64:
+		if typ.Kind() == reflect.String {
+			return strconv.FormatFloat(value, 'f', -1, 64), nil
+		}
+	case string:
+		switch {
+		case typ == durationType:
+			if _, err := time.ParseDuration(value); err != nil {
+				return "", errors.New("expected duration like 5s, 1m or 2h")
+			}
+			return value, nil
+		case typ.Kind() == reflect.String:
+			return value, nil
+		}
+	}
+
+	switch {
+	case typ == durationType:
+		return "", errors.New("expected duration like 5s, 1m or 2h")
+	case typ.Kind() == reflect.Int:
+		return "", errors.New("expected integer")
+	case typ.Kind() == reflect.Bool:
+		return "", errors.New("expected true or false")
+	default:
+		return "", errors.New("expected string")
+	}
+}
+
+// Redacted returns Cfg in YAML file format with secrets hidden
+func Redacted() ([]byte, error) {
+	return yaml.Marshal(redactedNode(reflect.ValueOf(Cfg), schema(reflect.TypeFor[Config]())))
+}
+
+func redactedNode(value reflect.Value, settings []setting) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range settings {
+		field := value.Field(s.index)
+		var item *yaml.Node
+
+		switch {
+		case s.items != nil:
+			item = &yaml.Node{Kind: yaml.SequenceNode}
+			for i := range field.Len() {
+				item.Content = append(item.Content, redactedNode(field.Index(i), s.items))
+			}
+		case field.Kind() == reflect.Slice:
+			item = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+			for i := range field.Len() {
+				item.Content = append(item.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: redact(s.tag.Get("redact"), field.Index(i).String())})
+			}
+		default:
+			item = &yaml.Node{}
+			_ = item.Encode(field.Interface())
+			if s.typ == durationType {
+				item = &yaml.Node{Kind: yaml.ScalarNode, Value: time.Duration(field.Int()).String()}
+			}
+			if field.Kind() == reflect.String {
+				item.Value = redact(s.tag.Get("redact"), field.String())
+			}
+		}
+
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.key}, item)
+	}
+
+	return node
+}
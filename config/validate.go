@@ -0,0 +1,176 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"rgosocks/geoip"
+	"rgosocks/schedule"
+	"rgosocks/script"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+)
+
+const redactedValue = "REDACTED"
+
+func parseEnv(cfg *Config, environment map[string]string) error {
+	return env.ParseWithOptions(cfg, env.Options{Environment: environment})
+}
+
+// redact hides secret value, mode is redact tag of setting:
+// "true" hides whole value, "url" hides password of URL
+func redact(mode, value string) string {
+	if value == "" {
+		return value
+	}
+
+	switch mode {
+	case "true":
+		return redactedValue
+	case "url":
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redactedValue)
+				return u.String()
+			}
+		}
+	}
+
+	return value
+}
+
+// Validate checks addresses, CIDRs and FQDN patterns of Cfg by validate tags
+// of settings, errors refer to line of config file when setting is loaded from it
+func Validate() error {
+	return validateSettings(reflect.ValueOf(Cfg), schema(reflect.TypeFor[Config]()), "")
+}
+
+func validateSettings(value reflect.Value, settings []setting, prefix string) error {
+	var errs []error
+	for _, s := range settings {
+		field := value.Field(s.index)
+		name := prefix + s.env
+
+		if s.items != nil {
+			for i := range field.Len() {
+				errs = append(errs, validateSettings(field.Index(i), s.items, fmt.Sprintf("%s_%d_", name, i)))
+			}
+			continue
+		}
+
+		rule := s.tag.Get("validate")
+		if rule == "" {
+			continue
+		}
+
+		values := []string{field.String()}
+		if field.Kind() == reflect.Slice {
+			values = field.Interface().([]string)
+		}
+		for _, v := range values {
+			if err := validateValue(rule, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", origin(name), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateValue checks single non-empty value by rule:
+// cidr, ip, fqdn, address, url, country, asn, days, hours, timezone, script or oneof=a|b|c
+func validateValue(rule, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	switch rule, arg, _ := strings.Cut(rule, "="); rule {
+	case "cidr":
+		if !strings.Contains(value, "/") {
+			if net.ParseIP(value) == nil {
+				return fmt.Errorf("invalid IP address %q", value)
+			}
+			return nil
+		}
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return err
+		}
+	case "ip":
+		if net.ParseIP(value) == nil {
+			return fmt.Errorf("invalid IP address %q", value)
+		}
+	case "fqdn":
+		if !validFQDN(value) {
+			return fmt.Errorf("invalid domain name %q", value)
+		}
+	case "address":
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return err
+		}
+	case "url":
+		u, err := url.Parse(value)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid URL %q", value)
+		}
+	case "country":
+		if len(value) != 2 || strings.ContainsFunc(value, func(c rune) bool { return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') }) {
+			return fmt.Errorf("invalid country code %q, expected ISO 3166 code like US", value)
+		}
+	case "asn":
+		if _, err := geoip.ParseASN(value); err != nil {
+			return err
+		}
+	case "days":
+		if _, _, err := schedule.ParseDays(value); err != nil {
+			return err
+		}
+	case "hours":
+		if _, err := schedule.ParseWindow(value); err != nil {
+			return err
+		}
+	case "timezone":
+		if _, err := time.LoadLocation(value); err != nil {
+			return fmt.Errorf("unknown timezone %q", value)
+		}
+	case "script":
+		if _, err := script.Load(value); err != nil {
+			return err
+		}
+	case "oneof":
+		if values := strings.Split(arg, "|"); !slices.Contains(values, value) {
+			return fmt.Errorf("unknown value %q, expected one of %s", value, strings.Join(values, ", "))
+		}
+	}
+
+	return nil
+}
+
+// validFQDN checks name as sequence of dot separated labels of letters,
+// digits, hyphens and underscores, trailing dot is allowed
+func validFQDN(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for label := range strings.SplitSeq(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,183 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is country and autonomous system of IP address, fields are empty when
+// databases have no data of address
+type Info struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+}
+
+// record holds fields of GeoLite2/GeoIP2 Country, City and ASN databases
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// RefreshInterval is how often database files are checked for changes
+const RefreshInterval = time.Minute
+
+// DB looks up addresses in MaxMind format databases, like country and ASN
+// databases together. Databases are read into memory and reloaded by Reload
+// when modification time of any file changes. Lookup of nil DB returns empty Info.
+type DB struct {
+	files []string
+	// reloadMu serializes reloads, so changed databases are read once
+	reloadMu sync.Mutex
+
+	mu      sync.RWMutex
+	readers []*maxminddb.Reader
+	modTime time.Time
+}
+
+// Open loads databases of files
+func Open(files ...string) (*DB, error) {
+	d := &DB{files: files}
+	if err := d.load(d.lastModified()); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// lastModified returns latest modification time of database files
+func (d *DB) lastModified() time.Time {
+	var modTime time.Time
+	for _, file := range d.files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime
+}
+
+func (d *DB) load(modTime time.Time) error {
+	readers := make([]*maxminddb.Reader, 0, len(d.files))
+	for _, file := range d.files {
+		// database is read into memory, so replaced reader is not closed
+		// while lookups of other requests use it
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		reader, err := maxminddb.FromBytes(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		readers = append(readers, reader)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.readers = readers
+	d.modTime = modTime
+
+	return nil
+}
+
+// Reload loads databases again when files are changed, previous databases
+// are kept until files are fixed
+func (d *DB) Reload() {
+	d.reloadMu.Lock()
+	defer d.reloadMu.Unlock()
+
+	modTime := d.lastModified()
+
+	d.mu.RLock()
+	changed := !modTime.Equal(d.modTime)
+	d.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := d.load(modTime); err != nil {
+		slog.Error("Reload GeoIP database", "files", d.files, "err", err)
+
+		d.mu.Lock()
+		d.modTime = modTime
+		d.mu.Unlock()
+
+		return
+	}
+
+	slog.Info("Reload GeoIP database", "files", d.files)
+}
+
+// Refresh reloads changed databases every interval until ctx is done
+func (d *DB) Refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.Reload()
+		}
+	}
+}
+
+// Lookup returns country and autonomous system of ip, first database having
+// field of address wins
+func (d *DB) Lookup(ip net.IP) Info {
+	var info Info
+	if d == nil || ip == nil {
+		return info
+	}
+
+	d.mu.RLock()
+	readers := d.readers
+	d.mu.RUnlock()
+
+	for _, reader := range readers {
+		var r record
+		if err := reader.Lookup(ip, &r); err != nil {
+			slog.Debug("GeoIP lookup", "ip", ip, "err", err)
+			continue
+		}
+		if info.Country == "" {
+			info.Country = r.Country.ISOCode
+		}
+		if info.ASN == 0 {
+			info.ASN, info.Org = r.ASN, r.Org
+		}
+	}
+
+	return info
+}
+
+// ParseASN parses autonomous system number with optional AS prefix, like AS13335
+func ParseASN(text string) (uint, error) {
+	number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(text), "AS"), 10, 32)
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("invalid AS number %q", text)
+	}
+
+	return uint(number), nil
+}
+
+// FormatASN returns autonomous system number with AS prefix
+func FormatASN(asn uint) string {
+	return "AS" + strconv.FormatUint(uint64(asn), 10)
+}
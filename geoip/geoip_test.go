@@ -0,0 +1,163 @@
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// node is node of IPv4 search tree of test database
+type node struct {
+	children [2]*node
+	data     []byte
+}
+
+func encodeString(s string) []byte {
+	if len(s) >= 29 {
+		return append([]byte{2<<5 | 29, byte(len(s) - 29)}, s...)
+	}
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func encodeUint(kind byte, v uint64) []byte {
+	var value []byte
+	for ; v > 0; v >>= 8 {
+		value = append([]byte{byte(v)}, value...)
+	}
+	if kind > 7 {
+		return append([]byte{byte(len(value)), kind - 7}, value...)
+	}
+	return append([]byte{kind<<5 | byte(len(value))}, value...)
+}
+
+func encodeMap(pairs ...[]byte) []byte {
+	return append([]byte{7<<5 | byte(len(pairs)/2)}, bytes.Join(pairs, nil)...)
+}
+
+// writeDB writes IPv4 database in MaxMind DB format with records of networks
+func writeDB(t *testing.T, path string, records map[string]Info) {
+	root := &node{}
+	for cidr, info := range records {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, _ := ipNet.Mask.Size()
+
+		current := root
+		for bit := range ones {
+			side := ipNet.IP.To4()[bit/8] >> (7 - bit%8) & 1
+			if current.children[side] == nil {
+				current.children[side] = &node{}
+			}
+			current = current.children[side]
+		}
+		// databases have only fields of their type, like country or ASN
+		var fields [][]byte
+		if info.Country != "" {
+			fields = append(fields, encodeString("country"), encodeMap(encodeString("iso_code"), encodeString(info.Country)))
+		}
+		if info.ASN != 0 {
+			fields = append(fields, encodeString("autonomous_system_number"), encodeUint(6, uint64(info.ASN)),
+				encodeString("autonomous_system_organization"), encodeString(info.Org))
+		}
+		current.data = encodeMap(fields...)
+	}
+
+	// number inner nodes in breadth first order
+	var nodes []*node
+	index := map[*node]int{}
+	for queue := []*node{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, child := range queue[0].children {
+			if child != nil && child.data == nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	var tree, data bytes.Buffer
+	for _, n := range nodes {
+		for _, child := range n.children {
+			value := len(nodes)
+			switch {
+			case child == nil:
+			case child.data != nil:
+				value = len(nodes) + 16 + data.Len()
+				data.Write(child.data)
+			default:
+				value = index[child]
+			}
+			tree.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+
+	var file bytes.Buffer
+	file.Write(tree.Bytes())
+	file.Write(make([]byte, 16))
+	file.Write(data.Bytes())
+	file.WriteString("\xAB\xCD\xEFMaxMind.com")
+	file.Write(encodeMap(
+		encodeString("node_count"), encodeUint(6, uint64(len(nodes))),
+		encodeString("record_size"), encodeUint(5, 24),
+		encodeString("ip_version"), encodeUint(5, 4),
+		encodeString("database_type"), encodeString("Test"),
+		encodeString("binary_format_major_version"), encodeUint(5, 2),
+		encodeString("binary_format_minor_version"), encodeUint(5, 0),
+		encodeString("build_epoch"), encodeUint(9, uint64(time.Now().Unix())),
+	))
+
+	require.NoError(t, os.WriteFile(path, file.Bytes(), 0o600))
+}
+
+func TestLookup(t *testing.T) {
+	dir := t.TempDir()
+	countries := filepath.Join(dir, "country.mmdb")
+	asns := filepath.Join(dir, "asn.mmdb")
+	writeDB(t, countries, map[string]Info{"192.0.2.0/24": {Country: "DE"}, "198.51.100.0/24": {Country: "RU"}})
+	writeDB(t, asns, map[string]Info{"192.0.2.0/25": {ASN: 64500, Org: "Example Hosting"}})
+
+	db, err := Open(countries, asns)
+	require.NoError(t, err)
+
+	assert.Equal(t, Info{Country: "DE", ASN: 64500, Org: "Example Hosting"}, db.Lookup(net.ParseIP("192.0.2.10")))
+	assert.Equal(t, Info{Country: "DE"}, db.Lookup(net.ParseIP("192.0.2.200")))
+	assert.Equal(t, Info{}, db.Lookup(net.ParseIP("203.0.113.1")))
+	assert.Equal(t, Info{}, (*DB)(nil).Lookup(net.ParseIP("192.0.2.10")))
+
+	// database is reloaded when file changes by Reload
+	writeDB(t, countries, map[string]Info{"192.0.2.0/24": {Country: "NL"}})
+	require.NoError(t, os.Chtimes(countries, time.Now(), time.Now().Add(time.Minute)))
+	assert.Equal(t, "DE", db.Lookup(net.ParseIP("192.0.2.10")).Country)
+	db.Reload()
+	assert.Equal(t, "NL", db.Lookup(net.ParseIP("192.0.2.10")).Country)
+
+	// previous database is kept when file is broken
+	require.NoError(t, os.WriteFile(countries, []byte("broken"), 0o600))
+	require.NoError(t, os.Chtimes(countries, time.Now(), time.Now().Add(2*time.Minute)))
+	db.Reload()
+	assert.Equal(t, "NL", db.Lookup(net.ParseIP("192.0.2.10")).Country)
+
+	_, err = Open(countries)
+	assert.Error(t, err)
+}
+
+func TestParseASN(t *testing.T) {
+	for text, want := range map[string]uint{"13335": 13335, "AS13335": 13335, "as64500": 64500} {
+		asn, err := ParseASN(text)
+		assert.NoError(t, err)
+		assert.Equal(t, want, asn)
+	}
+
+	for _, text := range []string{"", "AS", "cloudflare", "0", "AS4294967296"} {
+		_, err := ParseASN(text)
+		assert.Error(t, err, text)
+	}
+
+	assert.Equal(t, "AS13335", FormatASN(13335))
+}
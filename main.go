@@ -1,122 +1,568 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
-	"os/signal"
+	"rgosocks/blocklist"
 	"rgosocks/config"
+	"rgosocks/geoip"
+	"rgosocks/policy"
+	"rgosocks/proxy"
 	"rgosocks/resolver"
 	"rgosocks/rules"
+	"rgosocks/schedule"
+	"rgosocks/script"
 	"rgosocks/slogger"
 	"rgosocks/stat"
-	"rgosocks/version"
+	"slices"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 	_ "time/tzdata"
 
 	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
 	"github.com/things-go/go-socks5"
+	"golang.org/x/sync/singleflight"
 )
 
-func startProxy(status *stat.Stat) {
-	// Prepare authenticator config
-	var authenticator []socks5.Authenticator
-	if config.Cfg.ProxyUser != "" && config.Cfg.ProxyPassword != "" {
-		authenticator = append(authenticator, socks5.UserPassAuthenticator{
-			Credentials: socks5.StaticCredentials{
-				config.Cfg.ProxyUser: config.Cfg.ProxyPassword,
-			},
-		})
-	}
-
-	// Prepare allowed IP networks
-	var allowedIPNet []*net.IPNet
-	for _, cidr := range config.Cfg.AllowedIPs {
-		// Process single ip as /32 network
+// parseIPNets parses CIDRs of setting name, single ip is processed as /32 or /128 network
+func parseIPNets(name string, cidrs []string) []*net.IPNet {
+	var ipNets []*net.IPNet
+	for _, cidr := range cidrs {
 		if !strings.Contains(cidr, "/") {
-			cidr = cidr + "/32"
+			if strings.Contains(cidr, ":") {
+				cidr = cidr + "/128"
+			} else {
+				cidr = cidr + "/32"
+			}
 		}
 		_, ipNet, err := net.ParseCIDR(cidr)
 		if err != nil {
-			slog.Error("Parse AllowedIPs", "err", err)
+			slog.Error("Parse "+name, "err", err)
 			os.Exit(1)
 		}
-		slog.Debug("Parse AllowedIPs", "ipNet", ipNet)
-		allowedIPNet = append(allowedIPNet, ipNet)
+		slog.Debug("Parse "+name, "ipNet", ipNet)
+		ipNets = append(ipNets, ipNet)
 	}
 
-	// Prepare reject IP networks
-	var rejectIPNet []*net.IPNet
-	for _, cidr := range config.Cfg.RejectIPs {
-		// Process single ip as /32 network
-		if !strings.Contains(cidr, "/") {
-			cidr = cidr + "/32"
+	return ipNets
+}
+
+// shared holds components used by servers of all listeners
+type shared struct {
+	status   *stat.Stat
+	resolver socks5.NameResolver
+	conns    *proxy.ConnTable
+	udp      *proxy.UDPRelay
+	bind     *proxy.BindRelay
+	users    proxy.Users
+	rules    *ruleData
+}
+
+// ruleData holds databases and lists used by rules of all listeners
+type ruleData struct {
+	geoIP        *geoip.DB
+	allowedLists []*blocklist.List
+	rejectLists  []*blocklist.List
+	schedules    schedule.Schedules
+	policy       *policy.Client
+	script       *script.Script
+}
+
+// loadUsers returns credentials of PROXY_USERS_FILE and PROXY_USER
+func loadUsers() proxy.Users {
+	users := make(proxy.Users)
+	if config.Cfg.UsersFile != "" {
+		var err error
+		if users, err = proxy.LoadUsers(config.Cfg.UsersFile); err != nil {
+			slog.Error("Load users file", "err", err)
+			os.Exit(1)
 		}
-		_, ipNet, err := net.ParseCIDR(cidr)
+	}
+
+	if config.Cfg.ProxyUser != "" && config.Cfg.ProxyPassword != "" {
+		users[config.Cfg.ProxyUser] = config.Cfg.ProxyPassword
+	}
+
+	return users
+}
+
+// parseASNs parses AS numbers of setting name, numbers are checked by config validation
+func parseASNs(name string, values []string) []uint {
+	var asns []uint
+	for _, value := range values {
+		asn, err := geoip.ParseASN(value)
 		if err != nil {
-			slog.Error("Parse RejectIPs", "err", err)
+			slog.Error("Parse "+name, "err", err)
 			os.Exit(1)
 		}
-		slog.Debug("Parse RejectIPs", "ipNet", ipNet)
-		rejectIPNet = append(rejectIPNet, ipNet)
+		asns = append(asns, asn)
 	}
 
-	var dnsCache *cache.Cache = nil
-	if config.Cfg.DnsUseCache {
-		dnsCache = cache.New(1*time.Minute, 3*time.Minute)
+	return asns
+}
+
+// openGeoIP loads databases of PROXY_GEOIP_DB, nil is returned when they are not set
+func openGeoIP() *geoip.DB {
+	if len(config.Cfg.GeoipDatabases) == 0 {
+		if len(config.Cfg.AllowedCountries) > 0 || len(config.Cfg.RejectCountries) > 0 ||
+			len(config.Cfg.AllowedASNs) > 0 || len(config.Cfg.RejectASNs) > 0 {
+			slog.Error("Country and ASN rules require PROXY_GEOIP_DB")
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	db, err := geoip.Open(config.Cfg.GeoipDatabases...)
+	if err != nil {
+		slog.Error("Load GeoIP database", "err", err)
+		os.Exit(1)
+	}
+
+	return db
+}
+
+// loadLists loads blocklists of files or URLs of setting name
+func loadLists(name string, sources []string) []*blocklist.List {
+	var lists []*blocklist.List
+	for _, source := range sources {
+		list, err := blocklist.Load(context.Background(), source, nil)
+		if err != nil {
+			slog.Error("Load "+name, "source", source, "err", err)
+			os.Exit(1)
+		}
+		slog.Debug("Load "+name, "source", source, "entries", list.Len())
+		lists = append(lists, list)
+	}
+
+	return lists
+}
+
+// parseSchedules parses PROXY_SCHEDULE_<n> settings, values are checked by config validation
+func parseSchedules() schedule.Schedules {
+	var schedules schedule.Schedules
+	for i, s := range config.Cfg.Schedules {
+		parsed, err := schedule.Parse(s.Users, s.Days, s.Hours, s.Timezone, s.Cut)
+		if err != nil {
+			slog.Error("Parse schedule", "schedule", i, "err", err)
+			os.Exit(1)
+		}
+		schedules = append(schedules, parsed)
+	}
+
+	return schedules
+}
+
+// loadRuleData opens GeoIP databases and loads blocklists and script of config
+func loadRuleData() *ruleData {
+	return &ruleData{
+		geoIP:        openGeoIP(),
+		allowedLists: loadLists("AllowedLists", config.Cfg.AllowedLists),
+		rejectLists:  loadLists("RejectLists", config.Cfg.RejectLists),
+		schedules:    parseSchedules(),
+		policy:       newPolicy(),
+		script:       loadScript(),
+	}
+}
+
+// loadScript compiles rules of PROXY_RULES_SCRIPT, nil is returned when it is not set
+func loadScript() *script.Script {
+	if config.Cfg.RulesScript == "" {
+		return nil
+	}
+
+	s, err := script.Load(config.Cfg.RulesScript)
+	if err != nil {
+		slog.Error("Load script", "err", err)
+		os.Exit(1)
+	}
+	slog.Debug("Load script", "file", s.Path, "rules", len(s.Rules()))
+
+	return s
+}
+
+// newPolicy builds client of PROXY_POLICY_URL, nil is returned when it is not set
+func newPolicy() *policy.Client {
+	if config.Cfg.PolicyURL == "" {
+		return nil
+	}
+
+	return &policy.Client{
+		URL:      config.Cfg.PolicyURL,
+		Token:    config.Cfg.PolicyToken,
+		Timeout:  config.Cfg.PolicyTimeout,
+		CacheTTL: config.Cfg.PolicyCacheTtl,
+		FailOpen: config.Cfg.PolicyFailOpen,
+		Stats:    new(policy.Stats),
+	}
+}
+
+// newRules builds rules of listener, listener rules replace global rules when
+// any of them is defined. Country, ASN, blocklist, schedule, script and policy
+// rules are global and apply to all listeners.
+func newRules(listener config.Listener, data *ruleData) *rules.ProxyRulesSet {
+	allowedFQDN, rejectFQDN := config.Cfg.AllowedDestFQDN, config.Cfg.RejectDestFQDN
+	allowedIPs, rejectIPs := config.Cfg.AllowedIPs, config.Cfg.RejectIPs
+	if len(listener.AllowedDestFQDN) > 0 || len(listener.RejectDestFQDN) > 0 ||
+		len(listener.AllowedIPs) > 0 || len(listener.RejectIPs) > 0 {
+		allowedFQDN, rejectFQDN = listener.AllowedDestFQDN, listener.RejectDestFQDN
+		allowedIPs, rejectIPs = listener.AllowedIPs, listener.RejectIPs
+	}
+
+	var allowedCountries, rejectCountries []string
+	for _, country := range config.Cfg.AllowedCountries {
+		allowedCountries = append(allowedCountries, strings.ToUpper(country))
+	}
+	for _, country := range config.Cfg.RejectCountries {
+		rejectCountries = append(rejectCountries, strings.ToUpper(country))
+	}
+
+	ruleSet := &rules.ProxyRulesSet{
+		AllowedIPNet:     parseIPNets("AllowedIPs", allowedIPs),
+		RejectIPNet:      parseIPNets("RejectIPs", rejectIPs),
+		AllowedFQDN:      allowedFQDN,
+		RejectFQDN:       rejectFQDN,
+		AllowedCountries: allowedCountries,
+		RejectCountries:  rejectCountries,
+		AllowedASNs:      parseASNs("AllowedASNs", config.Cfg.AllowedASNs),
+		RejectASNs:       parseASNs("RejectASNs", config.Cfg.RejectASNs),
+		AllowedLists:     data.allowedLists,
+		RejectLists:      data.rejectLists,
+		Schedules:        data.schedules,
+		Policy:           data.policy,
+		Script:           data.script,
+		Audit:            config.Cfg.RulesAudit,
+		Hits:             new(rules.Hits),
+	}
+	if data.geoIP != nil {
+		ruleSet.GeoIP = data.geoIP
+	}
+
+	return ruleSet
+}
+
+// newProxyServer builds server of listener with its own credentials, rules and
+// egress address, settings not defined by listener are inherited from global
+// config. clientAuth replaces password authentication of socks5 when not nil.
+func newProxyServer(shared *shared, listener config.Listener, clientAuth *proxy.ClientAuth) *proxy.Server {
+	// Prepare authenticator config, listener credentials replace global users
+	users := shared.users
+	if listener.User != "" || listener.Password != "" {
+		users = proxy.Users{}
+		if listener.User != "" && listener.Password != "" {
+			users[listener.User] = listener.Password
+		}
+	}
+
+	var authenticator []socks5.Authenticator
+	if clientAuth != nil {
+		authenticator = append(authenticator, clientAuth)
+	}
+	var credentials socks5.CredentialStore
+	if !listener.NoAuth && len(users) > 0 {
+		credentials = users
+		// clients of certificate listener are authenticated by certificate only
+		if clientAuth == nil {
+			authenticator = append(authenticator, socks5.UserPassAuthenticator{
+				Credentials: credentials,
+			})
+		}
+	}
+
+	if credentials != nil && !config.Cfg.DisableSocks4 && !config.Cfg.Socks4CheckUser {
+		slog.Warn("SOCKS4 clients are rejected by listener requiring authentication, PROXY_SOCKS4_CHECK_USERID is disabled",
+			"address", listener.Address)
+	}
+
+	proxyRules := newRules(listener, shared.rules)
+
+	egressAddress := config.Cfg.EgressAddress
+	if listener.EgressAddress != "" {
+		egressAddress = listener.EgressAddress
+	}
+	var egressIP net.IP
+	if egressAddress != "" {
+		if egressIP = net.ParseIP(egressAddress); egressIP == nil {
+			slog.Error("Parse egress address", "address", egressAddress)
+			os.Exit(1)
+		}
+	}
+	dial := shared.status.Dialer(egressIP)
+
+	proxyProtocol := config.Cfg.ProxyProtocol
+	if len(listener.ProxyProtocol) > 0 {
+		proxyProtocol = listener.ProxyProtocol
+	}
+
+	handler := &proxy.Handler{
+		Credentials: credentials,
+		Rules:       proxyRules,
+		Resolver:    shared.resolver,
+		Dial:        dial,
+		Conns:       shared.conns,
+		UDP:         shared.udp,
+		Bind:        shared.bind,
+		GeoIP:       shared.rules.geoIP,
+		EgressDial:  shared.status.Dialer,
+	}
+	if config.Cfg.SniffRules {
+		handler.SniffTimeout = config.Cfg.SniffTimeout
 	}
 
 	// Configure socks5 server
 	server := socks5.NewServer(
 		socks5.WithLogger(&slogger.Socks5Logger{}),
 		socks5.WithAuthMethods(authenticator),
-		socks5.WithRule(&rules.ProxyRulesSet{
-			AllowedIPNet: allowedIPNet,
-			RejectIPNet:  rejectIPNet,
-			AllowedFQDN:  config.Cfg.AllowedDestFQDN,
-			RejectFQDN:   config.Cfg.RejectDestFQDN,
-		}),
-		socks5.WithResolver(&resolver.DNSResolver{
-			Cache:      dnsCache,
-			DNSClient:  new(dns.Client),
-			DNSAddress: net.JoinHostPort(config.Cfg.DnsHost, fmt.Sprintf("%d", config.Cfg.DnsPort)),
-		}),
-		socks5.WithDial(status.Dial),
+		socks5.WithRule(proxyRules),
+		socks5.WithResolver(shared.resolver),
+		socks5.WithDial(dial),
+		socks5.WithConnectHandle(handler.Socks5Connect),
+		socks5.WithAssociateHandle(handler.Socks5Associate),
+		socks5.WithBindHandle(handler.Socks5Bind),
 	)
 
-	slog.Info("Starting Socks5 Proxy", "address", config.Cfg.ProxyAddress)
-	if err := server.ListenAndServe("tcp", config.Cfg.ProxyAddress); err != nil {
-		panic(err)
+	return &proxy.Server{
+		Handler:           handler,
+		Socks5:            server,
+		HTTP:              listener.HttpSniff,
+		Socks4:            !config.Cfg.DisableSocks4,
+		Socks4CheckUserId: config.Cfg.Socks4CheckUser,
+		ClientAuth:        clientAuth,
+		ProxyProtocol:     parseIPNets("ProxyProtocolTrusted", proxyProtocol),
 	}
 }
 
-func main() {
-	ver, commit, date, goVer, arch := version.Info()
-	slog.Info("Version", "version", ver, "commit", commit, "date", date, "go", goVer, "arch", arch)
-	config.Parse()
+// newResolver builds DNS resolver of config
+func newResolver() *resolver.DNSResolver {
+	var dnsCache *cache.Cache = nil
+	if config.Cfg.DnsUseCache {
+		dnsCache = cache.New(1*time.Minute, 3*time.Minute)
+	}
 
-	if config.Cfg.LogLevelDebug {
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+	dnsResolver := &resolver.DNSResolver{
+		Cache:      dnsCache,
+		DNSClient:  &dns.Client{Timeout: config.Cfg.DnsTimeout},
+		DNSAddress: net.JoinHostPort(config.Cfg.DnsHost, fmt.Sprintf("%d", config.Cfg.DnsPort)),
+		Group:      new(singleflight.Group),
+		Stats:      new(resolver.Stats),
 	}
+	switch config.Cfg.DnsDnssec {
+	case resolver.DnssecOff:
+	case resolver.DnssecAD, resolver.DnssecValidate:
+		if config.Cfg.DnsHost == "" {
+			slog.Error("DNS_DNSSEC requires custom DNS server", "dnssec", config.Cfg.DnsDnssec)
+			os.Exit(1)
+		}
 
-	slog.Debug("Config", "env", config.Cfg)
+		if config.Cfg.DnsDnssec == resolver.DnssecValidate {
+			anchor, err := resolver.LoadTrustAnchor(config.Cfg.DnsTrustAnchor)
+			if err != nil {
+				slog.Error("Load DNSSEC trust anchor", "err", err)
+				os.Exit(1)
+			}
+			dnsResolver.TrustAnchor = anchor
+		}
+	default:
+		slog.Error("Unknown DNS_DNSSEC mode", "dnssec", config.Cfg.DnsDnssec)
+		os.Exit(1)
+	}
 
-	statusServer := stat.NewStat(
-		config.Cfg.StatusEnabled,
-		config.Cfg.StatusAddress,
-		config.Cfg.StatusBearer,
-	)
+	return dnsResolver
+}
+
+func startProxy(status *stat.Stat) {
+	dnsResolver := newResolver()
+	status.AddMetrics("dns", dnsResolver.Stats.Snapshot)
+	status.Handle("/dns/", dnsResolver.CacheHandler())
+
+	conns := proxy.NewConnTable()
+	status.Handle("GET /connections", conns.Handler())
+
+	udpRelay := &proxy.UDPRelay{
+		PortMin:      config.Cfg.UdpPortMin,
+		PortMax:      config.Cfg.UdpPortMax,
+		IdleTimeout:  config.Cfg.UdpIdleTimeout,
+		MaxTargets:   config.Cfg.UdpMaxTargets,
+		AllowedUsers: config.Cfg.UdpAllowedUsers,
+		DeniedUsers:  config.Cfg.UdpDeniedUsers,
+		Stats:        new(proxy.UDPStats),
+	}
+	status.AddMetrics("udp", udpRelay.Stats.Snapshot)
+
+	bindRelay := &proxy.BindRelay{
+		PortMin:       config.Cfg.BindPortMin,
+		PortMax:       config.Cfg.BindPortMax,
+		AcceptTimeout: config.Cfg.BindAcceptTimeout,
+		AllowedPeers:  parseIPNets("BindAllowedPeers", config.Cfg.BindAllowedPeers),
+		Track:         status.Track,
+	}
+	if config.Cfg.BindExternalIP != "" {
+		if bindRelay.ExternalIP = net.ParseIP(config.Cfg.BindExternalIP); bindRelay.ExternalIP == nil {
+			slog.Error("Parse bind external IP", "address", config.Cfg.BindExternalIP)
+			os.Exit(1)
+		}
+	}
+
+	servers := &shared{
+		status:   status,
+		resolver: dnsResolver,
+		conns:    conns,
+		udp:      udpRelay,
+		bind:     bindRelay,
+		users:    loadUsers(),
+		rules:    loadRuleData(),
+	}
+	if servers.rules.geoIP != nil {
+		go servers.rules.geoIP.Refresh(context.Background(), geoip.RefreshInterval)
+	}
+	if servers.rules.script != nil {
+		go servers.rules.script.Refresh(context.Background(), script.RefreshInterval)
+	}
+	if lists := slices.Concat(servers.rules.allowedLists, servers.rules.rejectLists); len(lists) > 0 && config.Cfg.ListsRefresh > 0 {
+		go blocklist.Refresh(context.Background(), lists, config.Cfg.ListsRefresh)
+	}
+	if servers.rules.policy != nil {
+		status.AddMetrics("policy", servers.rules.policy.Stats.Snapshot)
+	}
+	if slices.ContainsFunc(servers.rules.schedules, func(s schedule.Schedule) bool { return s.Cut }) {
+		go proxy.CutSchedules(context.Background(), conns, servers.rules.schedules, proxy.ScheduleCheckInterval)
+	}
+
+	defaultListener := config.Listener{
+		Network:   "tcp",
+		Address:   config.Cfg.ProxyAddress,
+		HttpSniff: config.Cfg.ProxyHttpSniff,
+	}
+	proxyServer := newProxyServer(servers, defaultListener, nil)
+
+	// handlers of listeners by index for rules endpoints, main listener is "",
+	// TLS listener with client certificates has its own rules as "tls"
+	handlers := map[string]*proxy.Handler{"": proxyServer.Handler}
+
+	if config.Cfg.ProxyHttpAddress != "" {
+		go func() {
+			slog.Info("Starting HTTP Proxy", "address", config.Cfg.ProxyHttpAddress)
+			httpServer := &proxy.Server{Handler: proxyServer.Handler, HTTP: true, ProxyProtocol: proxyServer.ProxyProtocol}
+			if err := httpServer.ListenAndServe("tcp", config.Cfg.ProxyHttpAddress); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if config.Cfg.ProxyTlsAddress != "" {
+		certs, err := proxy.NewCertReloader(config.Cfg.ProxyTlsCert, config.Cfg.ProxyTlsKey)
+		if err != nil {
+			slog.Error("Load TLS certificate", "err", err)
+			os.Exit(1)
+		}
+
+		tlsConfig := certs.TLSConfig()
+		tlsServer := proxyServer
+		if config.Cfg.TlsClientCa != "" {
+			clientAuth, err := proxy.NewClientAuth(config.Cfg.TlsClientCa, config.Cfg.TlsClientCrl, config.Cfg.TlsClientUser)
+			if err != nil {
+				slog.Error("Load TLS client CA", "err", err)
+				os.Exit(1)
+			}
+			clientAuth.Configure(tlsConfig)
 
-	go startProxy(statusServer)
+			// client certificate is required by handshake, so socks5 clients select
+			// "no authentication" and are not asked for password
+			tlsServer = newProxyServer(servers, defaultListener, clientAuth)
+			handlers["tls"] = tlsServer.Handler
+		}
+
+		go func() {
+			slog.Info("Starting Socks5 TLS Proxy", "address", config.Cfg.ProxyTlsAddress, "clientCert", tlsServer.ClientAuth != nil)
+			if err := tlsServer.ListenAndServeTLS("tcp", config.Cfg.ProxyTlsAddress, tlsConfig); err != nil {
+				panic(err)
+			}
+		}()
+	}
 
-	sigs := make(chan os.Signal, 1)
+	if config.Cfg.TransparentAddress != "" {
+		transparentServer := &proxy.TransparentServer{
+			Handler: proxyServer.Handler,
+			Mode:    config.Cfg.TransparentMode,
+		}
+		if config.Cfg.TransparentSniff {
+			transparentServer.SniffTimeout = config.Cfg.SniffTimeout
+		}
 
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			slog.Info("Starting Transparent Proxy", "address", config.Cfg.TransparentAddress, "mode", config.Cfg.TransparentMode)
+			if err := transparentServer.ListenAndServe("tcp", config.Cfg.TransparentAddress); err != nil {
+				panic(err)
+			}
+		}()
+	}
 
-	sig := <-sigs
-	slog.Debug("Signal", "sig", sig.String())
+	for i, forward := range config.Cfg.Forwards {
+		forwardServer, err := proxy.NewForward(proxyServer.Handler, forward.Target, forward.Parent)
+		if err != nil {
+			slog.Error("Parse forward", "forward", i, "err", err)
+			os.Exit(1)
+		}
+
+		go func() {
+			slog.Info("Starting Forward", "forward", i, "address", forward.Listen, "target", forward.Target, "parent", forwardServer.Parent != nil)
+			if err := forwardServer.ListenAndServe("tcp", forward.Listen); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	for i, listener := range config.Cfg.Listeners {
+		switch listener.Network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			slog.Error("Unknown listener network", "listener", i, "network", listener.Network)
+			os.Exit(1)
+		}
+		if listener.Address == "" {
+			slog.Error("Listener address is empty", "listener", i)
+			os.Exit(1)
+		}
+
+		server := newProxyServer(servers, listener, nil)
+		handlers[strconv.Itoa(i)] = server.Handler
+		go func() {
+			slog.Info("Starting Socks5 Proxy", "listener", i, "network", listener.Network, "address", listener.Address,
+				"auth", server.Handler.AuthRequired(), "http", listener.HttpSniff)
+			if err := server.ListenAndServe(listener.Network, listener.Address); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	listenerHandler := func(listener string) *proxy.Handler {
+		return handlers[listener]
+	}
+	status.Handle("GET /rules/explain", proxy.ExplainHandler(listenerHandler))
+	status.Handle("GET /rules/hits", proxy.HitsHandler(listenerHandler))
+	status.AddMetrics("rules", func() any {
+		summaries := make(map[string]rules.HitsSummary)
+		for listener, handler := range handlers {
+			if ruleSet, ok := handler.Rules.(*rules.ProxyRulesSet); ok {
+				if listener == "" {
+					listener = "main"
+				}
+				summaries[listener] = ruleSet.HitsSnapshot()
+			}
+		}
+		return summaries
+	})
+
+	slog.Info("Starting Socks5 Proxy", "address", config.Cfg.ProxyAddress, "http", config.Cfg.ProxyHttpSniff)
+	if err := proxyServer.ListenAndServe("tcp", config.Cfg.ProxyAddress); err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
 }
@@ -0,0 +1,206 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// maxCacheEntries limits count of cached decisions
+const maxCacheEntries = 10000
+
+// Request describes proxy request sent to policy service
+type Request struct {
+	User    string `json:"user"`
+	Client  string `json:"client"`
+	Command string `json:"command"`
+	FQDN    string `json:"fqdn,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Port    int    `json:"port"`
+}
+
+// Response is decision of policy service, TTL in seconds overrides cache
+// TTL of client when set
+type Response struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+	TTL    *int   `json:"ttl,omitempty"`
+}
+
+// Client asks policy service at URL by POST of JSON Request. Decisions are
+// cached for CacheTTL, concurrent identical requests share single call.
+type Client struct {
+	URL string
+	// Token is sent as bearer token when set
+	Token    string
+	Timeout  time.Duration
+	CacheTTL time.Duration
+	// FailOpen allows requests when service fails, otherwise they are denied
+	FailOpen bool
+	// HTTP sends requests, nil uses http.DefaultClient
+	HTTP  *http.Client
+	Stats *Stats
+
+	group singleflight.Group
+	mu    sync.Mutex
+	cache map[Request]cached
+}
+
+type cached struct {
+	response Response
+	expires  time.Time
+}
+
+// Decide returns decision of service for req. Error is returned with
+// decision of fail mode when service can not be asked.
+func (c *Client) Decide(ctx context.Context, req Request) (Response, error) {
+	if response, ok := c.cached(req); ok {
+		c.Stats.cacheHit()
+		return response, nil
+	}
+	c.Stats.cacheMiss()
+
+	// only the caller which started the call runs the function
+	leader := false
+	ch := c.group.DoChan(c.key(req), func() (any, error) {
+		leader = true
+
+		// call must not be cancelled with the context of first caller
+		callCtx := context.WithoutCancel(ctx)
+		if c.Timeout > 0 {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(callCtx, c.Timeout)
+			defer cancel()
+		}
+
+		return c.call(callCtx, req)
+	})
+
+	var response Response
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case res := <-ch:
+		if !leader {
+			c.Stats.coalesce()
+		}
+		if err = res.Err; err == nil {
+			response = res.Val.(Response)
+		}
+	}
+
+	if err != nil {
+		c.Stats.failure()
+		return Response{Allow: c.FailOpen, Reason: "policy service failed"}, err
+	}
+
+	return response, nil
+}
+
+func (c *Client) key(req Request) string {
+	data, _ := json.Marshal(req)
+	return string(data)
+}
+
+func (c *Client) cached(req Request) (Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.cache[req]
+	if !ok || time.Now().After(entry.expires) {
+		return Response{}, false
+	}
+
+	return entry.response, true
+}
+
+func (c *Client) store(req Request, response Response) {
+	ttl := c.CacheTTL
+	if response.TTL != nil {
+		ttl = time.Duration(*response.TTL) * time.Second
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cache == nil {
+		c.cache = make(map[Request]cached)
+	}
+	if len(c.cache) >= maxCacheEntries {
+		now := time.Now()
+		for key, entry := range c.cache {
+			if now.After(entry.expires) {
+				delete(c.cache, key)
+			}
+		}
+		// evict arbitrary entries when all of them are fresh
+		for key := range c.cache {
+			if len(c.cache) < maxCacheEntries {
+				break
+			}
+			delete(c.cache, key)
+		}
+	}
+
+	c.cache[req] = cached{response: response, expires: time.Now().Add(ttl)}
+}
+
+// call sends req to service and caches its decision
+func (c *Client) call(ctx context.Context, req Request) (Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	started := time.Now()
+	resp, err := client.Do(httpReq)
+	c.Stats.observe(time.Since(started))
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return Response{}, fmt.Errorf("policy service responded %s", resp.Status)
+	}
+
+	var response Response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&response); err != nil {
+		return Response{}, fmt.Errorf("policy service response: %w", err)
+	}
+
+	slog.Debug("Policy", "user", req.User, "client", req.Client, "command", req.Command,
+		"fqdn", req.FQDN, "ip", req.IP, "port", req.Port, "allow", response.Allow, "reason", response.Reason)
+
+	c.Stats.decision(response.Allow)
+	c.store(req, response)
+
+	return response, nil
+}
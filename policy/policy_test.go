@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newService starts stand-in policy service denying example.org
+func newService(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch req.FQDN {
+		case "example.org":
+			_ = json.NewEncoder(w).Encode(Response{Allow: false, Reason: "blocked for " + req.User})
+		case "nocache.example.com":
+			ttl := 0
+			_ = json.NewEncoder(w).Encode(Response{Allow: true, TTL: &ttl})
+		case "broken.example.com":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		case "slow.example.com":
+			time.Sleep(200 * time.Millisecond)
+			_ = json.NewEncoder(w).Encode(Response{Allow: true})
+		default:
+			_ = json.NewEncoder(w).Encode(Response{Allow: true})
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestDecide(t *testing.T) {
+	var calls atomic.Int32
+	server := newService(t, &calls)
+	client := &Client{URL: server.URL, Token: "secret", Timeout: time.Second, CacheTTL: time.Minute, Stats: new(Stats)}
+	ctx := context.Background()
+
+	response, err := client.Decide(ctx, Request{User: "alice", Command: "connect", FQDN: "example.org", Port: 443})
+	require.NoError(t, err)
+	assert.False(t, response.Allow)
+	assert.Equal(t, "blocked for alice", response.Reason)
+
+	// decision is cached
+	response, err = client.Decide(ctx, Request{User: "alice", Command: "connect", FQDN: "example.org", Port: 443})
+	require.NoError(t, err)
+	assert.False(t, response.Allow)
+	assert.Equal(t, int32(1), calls.Load())
+
+	response, err = client.Decide(ctx, Request{User: "alice", Command: "connect", FQDN: "example.com", Port: 443})
+	require.NoError(t, err)
+	assert.True(t, response.Allow)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// ttl of response disables cache
+	for range 2 {
+		response, err = client.Decide(ctx, Request{FQDN: "nocache.example.com"})
+		require.NoError(t, err)
+		assert.True(t, response.Allow)
+	}
+	assert.Equal(t, int32(4), calls.Load())
+
+	stats := client.Stats.Snapshot().(responseStats)
+	assert.Equal(t, uint64(4), stats.Calls)
+	assert.Equal(t, uint64(3), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Denied)
+	assert.Equal(t, uint64(1), stats.CacheHits)
+	assert.Equal(t, uint64(4), stats.CacheMisses)
+	assert.Equal(t, uint64(0), stats.Failures)
+
+	var counted uint64
+	for _, count := range stats.Latency {
+		counted += count
+	}
+	assert.Equal(t, uint64(4), counted)
+	assert.Len(t, stats.Latency, 9)
+}
+
+func TestDecideFailure(t *testing.T) {
+	var calls atomic.Int32
+	server := newService(t, &calls)
+	ctx := context.Background()
+
+	client := &Client{URL: server.URL, Token: "secret", Timeout: 50 * time.Millisecond, CacheTTL: time.Minute, Stats: new(Stats)}
+	for _, fqdn := range []string{"broken.example.com", "slow.example.com"} {
+		response, err := client.Decide(ctx, Request{FQDN: fqdn})
+		assert.Error(t, err, fqdn)
+		assert.False(t, response.Allow, fqdn)
+	}
+
+	// failures are not cached
+	client.FailOpen = true
+	response, err := client.Decide(ctx, Request{FQDN: "broken.example.com"})
+	assert.Error(t, err)
+	assert.True(t, response.Allow)
+	assert.Equal(t, uint64(3), client.Stats.Failures.Load())
+
+	// service rejects request without token
+	client.Token = ""
+	_, err = client.Decide(ctx, Request{FQDN: "example.com"})
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestDecideCoalesce(t *testing.T) {
+	var calls atomic.Int32
+	server := newService(t, &calls)
+	client := &Client{URL: server.URL, Token: "secret", Timeout: time.Second, Stats: new(Stats)}
+
+	results := make(chan Response, 5)
+	for range cap(results) {
+		go func() {
+			response, _ := client.Decide(context.Background(), Request{FQDN: "slow.example.com"})
+			results <- response
+		}()
+	}
+	for range cap(results) {
+		assert.True(t, (<-results).Allow)
+	}
+
+	assert.Less(t, calls.Load(), int32(5))
+	assert.Equal(t, uint64(5)-uint64(calls.Load()), client.Stats.Coalesced.Load())
+}
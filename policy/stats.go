@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are upper bounds of latency histogram of service calls
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Stats holds policy client counters exposed by status server.
+// All methods are safe to call on nil Stats.
+type Stats struct {
+	// Calls is the number of requests sent to service
+	Calls atomic.Uint64
+	// Failures is the number of decisions not received from service
+	Failures atomic.Uint64
+	// Allowed and Denied count decisions received from service
+	Allowed atomic.Uint64
+	Denied  atomic.Uint64
+	// CacheHits and CacheMisses count decisions looked up in cache
+	CacheHits   atomic.Uint64
+	CacheMisses atomic.Uint64
+	// Coalesced is the number of decisions received by call of another request
+	Coalesced atomic.Uint64
+
+	latencyTotal atomic.Int64
+	latencyMax   atomic.Int64
+	buckets      [9]atomic.Uint64
+}
+
+type responseStats struct {
+	Calls       uint64            `json:"calls"`
+	Failures    uint64            `json:"failures"`
+	Allowed     uint64            `json:"allowed"`
+	Denied      uint64            `json:"denied"`
+	CacheHits   uint64            `json:"cacheHits"`
+	CacheMisses uint64            `json:"cacheMisses"`
+	Coalesced   uint64            `json:"coalesced"`
+	LatencyAvg  float64           `json:"latencyAvgMs"`
+	LatencyMax  float64           `json:"latencyMaxMs"`
+	Latency     map[string]uint64 `json:"latency"`
+}
+
+func (s *Stats) observe(latency time.Duration) {
+	if s == nil {
+		return
+	}
+
+	s.Calls.Add(1)
+	s.latencyTotal.Add(int64(latency))
+	for {
+		current := s.latencyMax.Load()
+		if int64(latency) <= current || s.latencyMax.CompareAndSwap(current, int64(latency)) {
+			break
+		}
+	}
+
+	i := 0
+	for i < len(latencyBuckets) && latency > latencyBuckets[i] {
+		i++
+	}
+	s.buckets[i].Add(1)
+}
+
+func (s *Stats) failure() {
+	if s != nil {
+		s.Failures.Add(1)
+	}
+}
+
+func (s *Stats) decision(allowed bool) {
+	if s == nil {
+		return
+	}
+
+	if allowed {
+		s.Allowed.Add(1)
+	} else {
+		s.Denied.Add(1)
+	}
+}
+
+func (s *Stats) cacheHit() {
+	if s != nil {
+		s.CacheHits.Add(1)
+	}
+}
+
+func (s *Stats) cacheMiss() {
+	if s != nil {
+		s.CacheMisses.Add(1)
+	}
+}
+
+func (s *Stats) coalesce() {
+	if s != nil {
+		s.Coalesced.Add(1)
+	}
+}
+
+// Snapshot returns current counters for status response, latency histogram
+// counts calls by upper bound of their latency like "le_50ms"
+func (s *Stats) Snapshot() any {
+	if s == nil {
+		return responseStats{}
+	}
+
+	result := responseStats{
+		Calls:       s.Calls.Load(),
+		Failures:    s.Failures.Load(),
+		Allowed:     s.Allowed.Load(),
+		Denied:      s.Denied.Load(),
+		CacheHits:   s.CacheHits.Load(),
+		CacheMisses: s.CacheMisses.Load(),
+		Coalesced:   s.Coalesced.Load(),
+		LatencyMax:  float64(s.latencyMax.Load()) / float64(time.Millisecond),
+		Latency:     make(map[string]uint64, len(s.buckets)),
+	}
+
+	if result.Calls > 0 {
+		result.LatencyAvg = float64(s.latencyTotal.Load()) / float64(result.Calls) / float64(time.Millisecond)
+	}
+
+	for i := range s.buckets {
+		name := "inf"
+		if i < len(latencyBuckets) {
+			name = "le_" + latencyBuckets[i].String()
+		}
+		result.Latency[name] = s.buckets[i].Load()
+	}
+
+	return result
+}
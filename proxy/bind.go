@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// ProtocolSocks5Bind marks tunnels of socks5 BIND in connection table
+const ProtocolSocks5Bind = "socks5-bind"
+
+var ErrBindTimeout = errors.New("no peer connected to bind address")
+
+// BindRelay holds settings of socks5 BIND
+type BindRelay struct {
+	// PortMin and PortMax limit bound ports, zero allows any port
+	PortMin int
+	PortMax int
+	// ExternalIP is advertised to client instead of local address of
+	// bound socket, so peers behind NAT can connect back
+	ExternalIP net.IP
+	// AcceptTimeout limits waiting for peer, zero waits until client disconnects
+	AcceptTimeout time.Duration
+	// AllowedPeers may connect to bound socket. When empty, peer IP must
+	// match destination of BIND request unless it is unspecified.
+	AllowedPeers []*net.IPNet
+	// Track counts accepted peer connections in status, nil disables accounting
+	Track func(net.Conn) net.Conn
+}
+
+// listenPortRange calls listen with ports of range starting from random one,
+// so concurrent sockets do not race for the same ports
+func listenPortRange[T any](portMin, portMax int, listen func(port int) (T, error)) (T, error) {
+	if portMin <= 0 || portMax < portMin {
+		return listen(0)
+	}
+
+	size := portMax - portMin + 1
+	offset := rand.IntN(size)
+	var result T
+	var err error
+	for i := range size {
+		if result, err = listen(portMin + (offset+i)%size); err == nil {
+			return result, nil
+		}
+	}
+
+	return result, fmt.Errorf("no free port in range %d-%d: %w", portMin, portMax, err)
+}
+
+// listen opens bound socket on ip with port from configured range
+func (b *BindRelay) listen(ip net.IP) (*net.TCPListener, error) {
+	return listenPortRange(b.PortMin, b.PortMax, func(port int) (*net.TCPListener, error) {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+	})
+}
+
+// peerAllowed checks address of connected peer, expected is destination of BIND request
+func (b *BindRelay) peerAllowed(peer net.IP, expected net.IP) bool {
+	if len(b.AllowedPeers) > 0 {
+		for _, ipNet := range b.AllowedPeers {
+			if ipNet.Contains(peer) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return expected == nil || expected.IsUnspecified() || expected.Equal(peer)
+}
+
+// accept waits for allowed peer, other peers are closed
+func (b *BindRelay) accept(ln *net.TCPListener, expected net.IP) (net.Conn, error) {
+	if b.AcceptTimeout > 0 {
+		_ = ln.SetDeadline(time.Now().Add(b.AcceptTimeout))
+	}
+
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, ErrBindTimeout
+			}
+			return nil, err
+		}
+
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if b.peerAllowed(peer.IP, expected) {
+			return conn, nil
+		}
+
+		slog.Debug("BIND peer rejected", "peer", peer, "expected", expected)
+		_ = conn.Close()
+	}
+}
+
+// Socks5Bind replaces BIND handler of socks5 server. First reply holds
+// address for peer to connect, second one is sent with address of peer.
+func (h *Handler) Socks5Bind(ctx context.Context, writer io.Writer, req *socks5.Request) error {
+	conn, ok := writer.(net.Conn)
+	if !ok {
+		return fmt.Errorf("socks5: connection is %T", writer)
+	}
+
+	relay := h.Bind
+	if relay == nil {
+		relay = &BindRelay{}
+	}
+
+	local, ok := socketLocalAddr(conn).(*net.TCPAddr)
+	if !ok {
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return fmt.Errorf("socks5: local address is not TCP: %T", socketLocalAddr(conn))
+	}
+
+	// listener is bound to address of this host, not to address of PROXY
+	// protocol header
+	ln, err := relay.listen(local.IP)
+	if err != nil {
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return fmt.Errorf("socks5: bind: %w", err)
+	}
+
+	bindAddr := ln.Addr().(*net.TCPAddr)
+	advertised := bindAddr
+	if relay.ExternalIP != nil {
+		advertised = &net.TCPAddr{IP: relay.ExternalIP, Port: bindAddr.Port}
+	}
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, advertised); err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("socks5: send reply: %w", err)
+	}
+
+	slog.Debug("BIND", "remote", req.RemoteAddr, "bind", bindAddr, "advertised", advertised)
+
+	// bound socket is closed when client disconnects before peer arrives
+	client := &peekConn{Conn: conn, reader: bufio.NewReader(req.Reader)}
+	clientDone := watchConn(client)
+	waiting := make(chan struct{})
+	go func() {
+		select {
+		case <-waiting:
+		case <-clientDone:
+			_ = ln.Close()
+		}
+	}()
+
+	peer, err := relay.accept(ln, req.DestAddr.IP)
+	close(waiting)
+	_ = ln.Close()
+
+	// stop watching client, so tunnel is the only reader
+	_ = conn.SetReadDeadline(time.Now())
+	<-clientDone
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		reply := statute.RepServerFailure
+		if errors.Is(err, ErrBindTimeout) {
+			reply = statute.RepTTLExpired
+		}
+		_ = socks5.SendReply(writer, reply, nil)
+		return fmt.Errorf("socks5: bind %s: %w", bindAddr, err)
+	}
+	if relay.Track != nil {
+		peer = relay.Track(peer)
+	}
+	defer peer.Close()
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, peer.RemoteAddr()); err != nil {
+		return fmt.Errorf("socks5: send reply: %w", err)
+	}
+
+	id := h.Conns.Add(ConnInfo{
+		Protocol: ProtocolSocks5Bind,
+		User:     req.AuthContext.Payload["username"],
+		Client:   req.RemoteAddr.String(),
+		Dest:     peer.RemoteAddr().String(),
+		Started:  time.Now(),
+	}, client, peer)
+	defer h.Conns.Remove(id)
+
+	return tunnel(client, peer)
+}
+
+// watchConn signals when client closes connection or sends data, data is
+// kept in reader of conn
+func watchConn(conn *peekConn) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = conn.reader.Peek(1)
+	}()
+
+	return done
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// readSocks5Reply reads reply with IPv4 bound address
+func readSocks5Reply(t *testing.T, conn net.Conn) (byte, *net.TCPAddr) {
+	reply := make([]byte, 10)
+	_, err := io.ReadFull(conn, reply)
+	require.NoError(t, err)
+
+	return reply[1], &net.TCPAddr{
+		IP:   net.IPv4(reply[4], reply[5], reply[6], reply[7]),
+		Port: int(binary.BigEndian.Uint16(reply[8:])),
+	}
+}
+
+// socks5BindRequest sends no auth greeting and BIND with expected peer, returns first reply
+func socks5BindRequest(t *testing.T, addr string, peer net.IP) (net.Conn, byte, *net.TCPAddr) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	request := []byte{5, 1, 0, 5, statute.CommandBind, 0, 1}
+	request = append(request, peer.To4()...)
+	request = append(request, 0, 0)
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+	require.NoError(t, err)
+
+	status, bound := readSocks5Reply(t, conn)
+	return conn, status, bound
+}
+
+func TestSocks5Bind(t *testing.T) {
+	var tracked atomic.Int64
+	handler := newHandler(nil, &socks5.PermitCommand{EnableBind: true})
+	handler.Conns = NewConnTable()
+	handler.Bind = &BindRelay{
+		PortMin:       42000,
+		PortMax:       42100,
+		ExternalIP:    net.IPv4(192, 0, 2, 1),
+		AcceptTimeout: 300 * time.Millisecond,
+		Track: func(conn net.Conn) net.Conn {
+			tracked.Add(1)
+			return conn
+		},
+	}
+	addr := startServer(t, &Server{
+		Handler: handler,
+		Socks5: socks5.NewServer(
+			socks5.WithRule(handler.Rules),
+			socks5.WithBindHandle(handler.Socks5Bind),
+		),
+	})
+
+	conn, status, bound := socks5BindRequest(t, addr, net.IPv4(127, 0, 0, 1))
+	require.Equal(t, statute.RepSuccess, status)
+	assert.Equal(t, "192.0.2.1", bound.IP.String())
+	assert.True(t, bound.Port >= 42000 && bound.Port <= 42100, bound.Port)
+
+	peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bound.Port)))
+	require.NoError(t, err)
+	defer peer.Close()
+
+	status, peerAddr := readSocks5Reply(t, conn)
+	require.Equal(t, statute.RepSuccess, status)
+	assert.Equal(t, peer.LocalAddr().String(), peerAddr.String())
+	assert.Equal(t, int64(1), tracked.Load())
+
+	list := handler.Conns.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, ProtocolSocks5Bind, list[0].Protocol)
+
+	_, err = io.WriteString(peer, "220 ready\r\n")
+	require.NoError(t, err)
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "220 ready\r\n", string(buf))
+
+	_, err = io.WriteString(conn, "QUIT\r\n")
+	require.NoError(t, err)
+	buf = make([]byte, 6)
+	_, err = io.ReadFull(peer, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "QUIT\r\n", string(buf))
+
+	// peer other than destination of request is rejected until timeout
+	conn, status, bound = socks5BindRequest(t, addr, net.IPv4(10, 0, 0, 1))
+	require.Equal(t, statute.RepSuccess, status)
+
+	stranger, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bound.Port)))
+	require.NoError(t, err)
+	defer stranger.Close()
+	_ = stranger.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = stranger.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	status, _ = readSocks5Reply(t, conn)
+	assert.Equal(t, statute.RepTTLExpired, status)
+	assert.Equal(t, int64(1), tracked.Load())
+}
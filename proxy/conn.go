@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// peekConn allows to look at first bytes of connection without consuming them
+type peekConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (c *peekConn) Peek(n int) ([]byte, error) {
+	return c.reader.Peek(n)
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite keeps half-close of underlying TCP connection available for proxying
+func (c *peekConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// pipe copies src to dst and half-closes dst when src is drained
+func pipe(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+
+	return err
+}
+
+// tunnel copies data between client and target until both directions are done
+func tunnel(client *peekConn, target net.Conn) error {
+	errCh := make(chan error, 2)
+	go func() { errCh <- pipe(target, client.reader) }()
+	go func() { errCh <- pipe(client, target) }()
+
+	for range 2 {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
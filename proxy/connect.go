@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"rgosocks/geoip"
+	"rgosocks/rules"
+	"strings"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// Inbound protocols of connection table
+const (
+	ProtocolSocks5      = "socks5"
+	ProtocolSocks4      = "socks4"
+	ProtocolHTTP        = "http"
+	ProtocolTransparent = "transparent"
+	ProtocolForward     = "forward"
+)
+
+// Tunnel registers connection of client to target in connection table, logs
+// it and copies data between them. Country and ASN of destination are taken
+// from rules decision in ctx. When sniffing is enabled and req was made by IP,
+// hostname from first client bytes is checked by rules before any data is sent.
+func (h *Handler) Tunnel(ctx context.Context, protocol string, client *peekConn, target net.Conn, req *socks5.Request) error {
+	dest := req.DestAddr
+	if dest == nil {
+		dest = req.RawDestAddr
+	}
+
+	var geo geoip.Info
+	if decision, ok := rules.DecisionFromContext(ctx); ok {
+		geo = geoip.Info{Country: decision.Country, ASN: decision.ASN}
+	} else {
+		geo = h.GeoIP.Lookup(dest.IP)
+	}
+	info := ConnInfo{
+		Protocol: protocol,
+		User:     req.AuthContext.Payload["username"],
+		Client:   req.RemoteAddr.String(),
+		Dest:     dest.String(),
+		Host:     dest.FQDN,
+		Country:  geo.Country,
+		ASN:      geo.ASN,
+		Started:  time.Now(),
+	}
+	id := h.Conns.Add(info, client, target)
+	defer h.Conns.Remove(id)
+
+	slog.Info("Tunnel", "protocol", protocol, "remote", info.Client, "user", info.User, "dest", info.Dest,
+		"country", info.Country, "asn", info.ASN)
+
+	if h.SniffTimeout > 0 && dest.FQDN == "" {
+		if err := h.checkSniffed(ctx, client, id, req); err != nil {
+			return err
+		}
+	}
+
+	return tunnel(client, target)
+}
+
+// checkSniffed evaluates rules of request with hostname sniffed from client data
+func (h *Handler) checkSniffed(ctx context.Context, client *peekConn, id uint64, req *socks5.Request) error {
+	host := sniffHost(client, h.SniffTimeout)
+	if host == "" {
+		return nil
+	}
+
+	h.Conns.SetHost(id, host)
+
+	sniffed := *req
+	sniffed.DestAddr = &statute.AddrSpec{
+		FQDN:     host,
+		IP:       req.DestAddr.IP,
+		Port:     req.DestAddr.Port,
+		AddrType: req.DestAddr.AddrType,
+	}
+	if _, err := h.recheck(ctx, &sniffed); err != nil {
+		slog.Error("Sniffed host", "remote", req.RemoteAddr, "dest", req.DestAddr.String(), "host", host, "err", err)
+		return err
+	}
+
+	slog.Debug("Sniffed host", "remote", req.RemoteAddr, "dest", req.DestAddr.String(), "host", host)
+
+	return nil
+}
+
+// Socks5Connect replaces CONNECT handler of socks5 server, so socks5 tunnels
+// are registered in connection table and sniffed as other protocols
+func (h *Handler) Socks5Connect(ctx context.Context, writer io.Writer, req *socks5.Request) error {
+	conn, ok := writer.(net.Conn)
+	if !ok {
+		return fmt.Errorf("socks5: connection is %T", writer)
+	}
+
+	target, err := h.dialRoute(ctx, req, nil)
+	if err != nil {
+		reply := statute.RepHostUnreachable
+		if msg := err.Error(); strings.Contains(msg, "refused") {
+			reply = statute.RepConnectionRefused
+		} else if strings.Contains(msg, "network is unreachable") {
+			reply = statute.RepNetworkUnreachable
+		}
+		_ = socks5.SendReply(writer, reply, nil)
+		return fmt.Errorf("socks5: connect to %s: %w", req.RawDestAddr.Address(), err)
+	}
+	defer target.Close()
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
+		return fmt.Errorf("socks5: send reply: %w", err)
+	}
+
+	// reader of request holds bytes already buffered by socks5 server
+	client := &peekConn{Conn: conn, reader: bufio.NewReader(req.Reader)}
+
+	return h.Tunnel(ctx, ProtocolSocks5, client, target, req)
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"rgosocks/rules"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+)
+
+func TestSniffRules(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "origin "+r.Host)
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	ruleSet := &rules.ProxyRulesSet{
+		AllowedIPNet: []*net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+		RejectFQDN:   []string{"blocked.example"},
+		Hits:         &rules.Hits{},
+	}
+	handler := newHandler(nil, ruleSet)
+	handler.SniffTimeout = 200 * time.Millisecond
+	handler.Conns = NewConnTable()
+
+	addr := startServer(t, &Server{
+		Handler: handler,
+		Socks5:  socks5.NewServer(socks5.WithRule(ruleSet), socks5.WithConnectHandle(handler.Socks5Connect)),
+		Socks4:  true,
+	})
+
+	request := func(host string) (net.Conn, *http.Response, error) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		status, err := socks5Connect(conn, originAddr)
+		require.NoError(t, err)
+		require.Equal(t, byte(0), status)
+
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		return conn, resp, err
+	}
+
+	_, resp, err := request("allowed.example")
+	require.NoError(t, err)
+	assert.Equal(t, "origin allowed.example", readBody(t, resp))
+
+	// tunnel is registered with sniffed host until closed
+	list := handler.Conns.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, ProtocolSocks5, list[0].Protocol)
+	assert.Equal(t, originAddr.String(), list[0].Dest)
+	assert.Equal(t, "allowed.example", list[0].Host)
+
+	recorder := httptest.NewRecorder()
+	handler.Conns.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	var response responseConns
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, 1, response.Count)
+
+	// denied host closes tunnel before request reaches origin
+	_, _, err = request("Blocked.Example")
+	assert.Error(t, err)
+
+	// socks4 tunnels are checked too
+	conn, status := socks4Connect(t, addr, originAddr.IP, "", originAddr.Port, "")
+	defer conn.Close()
+	require.Equal(t, socks4Granted, status)
+	_, err = io.WriteString(conn, "GET / HTTP/1.0\r\nHost: blocked.example\r\n\r\n")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(conn)
+	assert.Empty(t, body)
+
+	// every tunnel is counted once, sniffed host only when it is denied
+	report := ruleSet.HitReport()
+	require.Len(t, report, 2)
+	assert.Equal(t, uint64(3), report[0].Allowed)
+	assert.Equal(t, rules.EntryHits{Rule: rules.RuleRejectFQDN, Entry: "blocked.example", Denied: 2, LastHit: report[1].LastHit}, report[1])
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes active tunnel of connection table
+type ConnInfo struct {
+	ID       uint64    `json:"id"`
+	Protocol string    `json:"protocol"`
+	User     string    `json:"user,omitempty"`
+	Client   string    `json:"client"`
+	Dest     string    `json:"dest"`
+	Host     string    `json:"host,omitempty"`
+	Country  string    `json:"country,omitempty"`
+	ASN      uint      `json:"asn,omitempty"`
+	Started  time.Time `json:"started"`
+}
+
+// ConnTable registers active tunnels of all inbound protocols. Methods of nil
+// table do nothing.
+type ConnTable struct {
+	mu      sync.RWMutex
+	next    uint64
+	conns   map[uint64]*ConnInfo
+	closers map[uint64][]io.Closer
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: make(map[uint64]*ConnInfo), closers: make(map[uint64][]io.Closer)}
+}
+
+// Add registers tunnel and returns its id, closers are connections of tunnel
+// closed by Close
+func (t *ConnTable) Add(info ConnInfo, closers ...io.Closer) uint64 {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.next++
+	info.ID = t.next
+	t.conns[info.ID] = &info
+	if len(closers) > 0 {
+		t.closers[info.ID] = closers
+	}
+
+	return info.ID
+}
+
+// Remove unregisters closed tunnel
+func (t *ConnTable) Remove(id uint64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, id)
+	delete(t.closers, id)
+}
+
+// Close closes connections of tunnels matching match and returns count of
+// closed tunnels, tunnels are removed by their handlers when copying stops
+func (t *ConnTable) Close(match func(ConnInfo) bool) int {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.RLock()
+	var closers []io.Closer
+	var count int
+	for id, info := range t.conns {
+		if match(*info) && len(t.closers[id]) > 0 {
+			closers = append(closers, t.closers[id]...)
+			count++
+		}
+	}
+	t.mu.RUnlock()
+
+	for _, closer := range closers {
+		_ = closer.Close()
+	}
+
+	return count
+}
+
+// SetHost records hostname sniffed from tunnel data
+func (t *ConnTable) SetHost(id uint64, host string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if info, ok := t.conns[id]; ok {
+		info.Host = host
+	}
+}
+
+// List returns active tunnels ordered by id
+func (t *ConnTable) List() []ConnInfo {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]ConnInfo, 0, len(t.conns))
+	for _, info := range t.conns {
+		result = append(result, *info)
+	}
+	slices.SortFunc(result, func(a, b ConnInfo) int { return cmp.Compare(a.ID, b.ID) })
+
+	return result
+}
+
+type responseConns struct {
+	Count int        `json:"count"`
+	Conns []ConnInfo `json:"conns"`
+}
+
+// Handler serves GET /connections of status server
+func (t *ConnTable) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		conns := t.List()
+		response, err := json.Marshal(responseConns{Count: len(conns), Conns: conns})
+		if err != nil {
+			writer.WriteHeader(500)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		_, _ = writer.Write(response)
+	})
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"rgosocks/rules"
+	"slices"
+	"strconv"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// Commands maps names of socks5 commands used by rule tools to their codes
+var Commands = map[string]byte{
+	"connect":   statute.CommandConnect,
+	"bind":      statute.CommandBind,
+	"associate": statute.CommandAssociate,
+}
+
+// ParseDest parses host:port into destination as client sends it
+func ParseDest(hostPort string) (statute.AddrSpec, error) {
+	host, portText, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return statute.AddrSpec{}, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 0 || port > 65535 {
+		return statute.AddrSpec{}, fmt.Errorf("invalid port %q", portText)
+	}
+
+	dest := statute.AddrSpec{Port: port}
+	if dest.IP = net.ParseIP(host); dest.IP == nil {
+		dest.FQDN = host
+		dest.AddrType = statute.ATYPDomain
+	} else if dest.IP.To4() != nil {
+		dest.AddrType = statute.ATYPIPv4
+	} else {
+		dest.AddrType = statute.ATYPIPv6
+	}
+
+	return dest, nil
+}
+
+// Explain resolves destination of req as Allow does and evaluates rules with
+// trace. Resolve error is returned with decision of FQDN rules only.
+func (h *Handler) Explain(ctx context.Context, req *socks5.Request) (rules.Decision, error) {
+	var resolveErr error
+	dest := *req.RawDestAddr
+	if dest.FQDN != "" && h.Resolver != nil {
+		if _, dest.IP, resolveErr = h.Resolver.Resolve(ctx, dest.FQDN); resolveErr != nil {
+			resolveErr = fmt.Errorf("%w: resolve %s: %v", ErrHostUnreachable, dest.FQDN, resolveErr)
+		}
+	}
+	req.DestAddr = &dest
+
+	if explainer, ok := h.Rules.(rules.Explainer); ok {
+		return explainer.Evaluate(ctx, req), resolveErr
+	}
+
+	// rule sets without explanation report result only
+	_, allowed := h.Rules.Allow(ctx, req)
+	decision := rules.Decision{Allowed: allowed, Reason: "rules denied request"}
+	if allowed {
+		decision.Reason = "rules allowed request"
+	}
+
+	return decision, resolveErr
+}
+
+type responseExplain struct {
+	Listener     string         `json:"listener"`
+	User         string         `json:"user,omitempty"`
+	Client       string         `json:"client,omitempty"`
+	Command      string         `json:"command"`
+	Dest         string         `json:"dest"`
+	IP           string         `json:"ip,omitempty"`
+	ResolveError string         `json:"resolveError,omitempty"`
+	Decision     rules.Decision `json:"decision"`
+}
+
+// ExplainHandler serves GET /rules/explain of status server. Query parameters
+// user, client, command (connect by default) and dest (host:port) describe
+// request, listener selects handler returned by handlers.
+func ExplainHandler(handlers func(listener string) *Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		response := responseExplain{
+			Listener: query.Get("listener"),
+			User:     query.Get("user"),
+			Client:   query.Get("client"),
+			Command:  query.Get("command"),
+			Dest:     query.Get("dest"),
+		}
+		if response.Command == "" {
+			response.Command = "connect"
+		}
+
+		handler := handlers(response.Listener)
+		if handler == nil {
+			http.Error(writer, "unknown listener", http.StatusNotFound)
+			return
+		}
+
+		command, ok := Commands[response.Command]
+		if !ok {
+			http.Error(writer, "unknown command", http.StatusBadRequest)
+			return
+		}
+
+		dest, err := ParseDest(response.Dest)
+		if err != nil {
+			http.Error(writer, "dest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var remote net.Addr = &net.TCPAddr{}
+		if response.Client != "" {
+			ip := net.ParseIP(response.Client)
+			if ip == nil {
+				http.Error(writer, "client: invalid IP address", http.StatusBadRequest)
+				return
+			}
+			remote = &net.TCPAddr{IP: ip}
+		}
+
+		req := NewRequest(command, dest, response.User, &net.TCPAddr{}, remote)
+		response.Decision, err = handler.Explain(request.Context(), req)
+		if err != nil {
+			response.ResolveError = err.Error()
+		}
+		if req.DestAddr.IP != nil {
+			response.IP = req.DestAddr.IP.String()
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			writer.WriteHeader(500)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		_, _ = writer.Write(data)
+	})
+}
+
+type responseHits struct {
+	Listener string            `json:"listener"`
+	Summary  rules.HitsSummary `json:"summary"`
+	Entries  []rules.EntryHits `json:"entries"`
+}
+
+// HitsHandler serves GET /rules/hits of status server with counters of rule
+// entries of listener. Query parameter unused=true lists entries without hits
+// only, sort=hits or sort=denied orders entries by hits.
+func HitsHandler(handlers func(listener string) *Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		response := responseHits{Listener: query.Get("listener")}
+
+		handler := handlers(response.Listener)
+		if handler == nil {
+			http.Error(writer, "unknown listener", http.StatusNotFound)
+			return
+		}
+		ruleSet, ok := handler.Rules.(*rules.ProxyRulesSet)
+		if !ok {
+			http.Error(writer, "rules of listener do not count hits", http.StatusNotFound)
+			return
+		}
+
+		response.Summary = ruleSet.HitsSnapshot()
+		response.Entries = ruleSet.HitReport()
+		if query.Get("unused") == "true" {
+			response.Entries = slices.DeleteFunc(response.Entries, func(entry rules.EntryHits) bool {
+				return entry.Allowed+entry.Denied > 0
+			})
+		}
+		switch query.Get("sort") {
+		case "":
+		case "hits", "denied":
+			rules.SortHits(response.Entries, query.Get("sort") == "denied")
+		default:
+			http.Error(writer, "unknown sort", http.StatusBadRequest)
+			return
+		}
+		if response.Entries == nil {
+			response.Entries = []rules.EntryHits{}
+		}
+
+		data, err := json.Marshal(response)
+		if err != nil {
+			writer.WriteHeader(500)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		_, _ = writer.Write(data)
+	})
+}
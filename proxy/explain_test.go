@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"rgosocks/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticResolver map[string]net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ip, ok := r[name]; ok {
+		return ctx, ip, nil
+	}
+	return ctx, nil, errors.New("no such host")
+}
+
+func TestExplainHandler(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	handler := newHandler(nil, &rules.ProxyRulesSet{RejectIPNet: []*net.IPNet{ipNet}, RejectFQDN: []string{"ads.example"}})
+	handler.Resolver = staticResolver{"intranet.example": net.IPv4(10, 1, 2, 3)}
+	explain := ExplainHandler(func(listener string) *Handler {
+		if listener == "" {
+			return handler
+		}
+		return nil
+	})
+
+	request := func(query string) (*httptest.ResponseRecorder, responseExplain) {
+		recorder := httptest.NewRecorder()
+		explain.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/rules/explain?"+query, nil))
+
+		var response responseExplain
+		if recorder.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		}
+		return recorder, response
+	}
+
+	recorder, response := request("user=alice&client=192.0.2.1&dest=intranet.example:443")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "alice", response.User)
+	assert.Equal(t, "connect", response.Command)
+	assert.Equal(t, "10.1.2.3", response.IP)
+	assert.False(t, response.Decision.Allowed)
+	assert.Equal(t, rules.RuleRejectIPs, response.Decision.Rule)
+	assert.Equal(t, "10.0.0.0/8", response.Decision.Entry)
+	assert.Len(t, response.Decision.Trace, 4)
+
+	// FQDN rules are evaluated when name is not resolved
+	_, response = request("dest=ads.example:80&command=bind")
+	assert.NotEmpty(t, response.ResolveError)
+	assert.Equal(t, rules.RuleRejectFQDN, response.Decision.Rule)
+
+	_, response = request("dest=192.0.2.10:80")
+	assert.True(t, response.Decision.Allowed)
+	assert.Equal(t, "no rule matched", response.Decision.Reason)
+
+	recorder, _ = request("dest=192.0.2.10:80&listener=1")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	recorder, _ = request("dest=192.0.2.10")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder, _ = request("dest=192.0.2.10:80&command=ping")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestHitsHandler(t *testing.T) {
+	handler := newHandler(nil, &rules.ProxyRulesSet{RejectFQDN: []string{"ads.example", "unused.example"}, Hits: new(rules.Hits)})
+	hits := HitsHandler(func(listener string) *Handler {
+		if listener == "" {
+			return handler
+		}
+		return nil
+	})
+
+	dest, err := ParseDest("ads.example:443")
+	require.NoError(t, err)
+	req := NewRequest(Commands["connect"], dest, "", &net.TCPAddr{}, &net.TCPAddr{})
+	req.DestAddr = &dest
+	_, allowed := handler.Rules.Allow(context.Background(), req)
+	require.False(t, allowed)
+
+	request := func(query string) (*httptest.ResponseRecorder, responseHits) {
+		recorder := httptest.NewRecorder()
+		hits.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/rules/hits?"+query, nil))
+
+		var response responseHits
+		if recorder.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		}
+		return recorder, response
+	}
+
+	recorder, response := request("sort=denied")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, rules.HitsSummary{Entries: 2, Unused: 1, Denied: 1}, response.Summary)
+	require.Len(t, response.Entries, 2)
+	assert.Equal(t, "ads.example", response.Entries[0].Entry)
+	assert.Equal(t, uint64(1), response.Entries[0].Denied)
+
+	_, response = request("unused=true")
+	require.Len(t, response.Entries, 1)
+	assert.Equal(t, "unused.example", response.Entries[0].Entry)
+
+	recorder, _ = request("listener=1")
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	recorder, _ = request("sort=name")
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// forwardDialTimeout limits connecting to target or parent proxy
+const forwardDialTimeout = 30 * time.Second
+
+// Forward connects every accepted client to fixed target, directly or through
+// parent proxy. Target is checked by rules as socks5 CONNECT without authentication.
+type Forward struct {
+	Handler *Handler
+	Target  statute.AddrSpec
+	// Parent is socks5 or http proxy used to reach target, nil connects directly.
+	// Target is not resolved locally when parent is used.
+	Parent *url.URL
+}
+
+// NewForward parses target host:port and optional parent proxy URL
+func NewForward(handler *Handler, target, parent string) (*Forward, error) {
+	dest, err := statute.ParseAddrSpec(target)
+	if err != nil {
+		return nil, fmt.Errorf("forward target %q: %w", target, err)
+	}
+
+	f := &Forward{Handler: handler, Target: dest}
+	if parent != "" {
+		if f.Parent, err = ParseParent(parent); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// ListenAndServe is used to create a listener and serve on it
+func (f *Forward) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	return f.Serve(l)
+}
+
+// Serve is used to serve connections from a listener
+func (f *Forward) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := f.ServeConn(conn); err != nil {
+				slog.Error("Forward", "remote", conn.RemoteAddr(), "target", f.Target.String(), "err", err)
+			}
+		}()
+	}
+}
+
+// dial checks target by rules and connects to it by route of rules, parent of
+// script rules overrides parent of forward. Returned context holds rules decision.
+func (f *Forward) dial(ctx context.Context, req *socks5.Request) (context.Context, net.Conn, error) {
+	if f.Parent == nil {
+		return f.Handler.Connect(ctx, req)
+	}
+
+	ctx, err := f.Handler.Check(ctx, req)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	target, err := f.Handler.dialRoute(ctx, req, f.Parent)
+	return ctx, target, err
+}
+
+// ServeConn is used to serve a single connection
+func (f *Forward) ServeConn(conn net.Conn) error {
+	c := newPeekConn(conn)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	defer cancel()
+
+	request := NewRequest(statute.CommandConnect, f.Target, "", conn.LocalAddr(), conn.RemoteAddr())
+	ctx, target, err := f.dial(ctx, request)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	slog.Debug("Forward connect", "remote", conn.RemoteAddr(), "target", f.Target.String())
+
+	return f.Handler.Tunnel(ctx, ProtocolForward, c, target, request)
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rgosocks/rules"
+	"rgosocks/script"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+)
+
+func startForward(t *testing.T, forward *Forward) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() { _ = forward.Serve(l) }()
+	t.Cleanup(func() { _ = l.Close() })
+
+	return l.Addr().String()
+}
+
+func forwardGet(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// connections rejected by forward are closed without response
+	_, _ = io.WriteString(conn, "GET / HTTP/1.0\r\nHost: origin\r\n\r\n")
+	body, _ := io.ReadAll(conn)
+
+	return string(body)
+}
+
+func TestForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "forward")
+	}))
+	defer origin.Close()
+	target := origin.Listener.Addr().String()
+	port := strconv.Itoa(origin.Listener.Addr().(*net.TCPAddr).Port)
+
+	// dials are counted as by stat.Stat.Dial
+	var dials atomic.Int32
+	handler := newHandler(nil, socks5.NewPermitAll())
+	dial := handler.Dial
+	handler.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return dial(ctx, network, addr)
+	}
+
+	forward, err := NewForward(handler, target, "")
+	require.NoError(t, err)
+	assert.Contains(t, forwardGet(t, startForward(t, forward)), "forward")
+	assert.Equal(t, int32(1), dials.Load())
+
+	// parent proxies
+	credentials := socks5.StaticCredentials{"user": "pass"}
+	socksParent := startServer(t, &Server{
+		Handler: newHandler(credentials, socks5.NewPermitAll()),
+		Socks5:  socks5.NewServer(socks5.WithCredential(credentials)),
+	})
+	httpParent := startServer(t, &Server{
+		Handler: newHandler(credentials, socks5.NewPermitAll()),
+		HTTP:    true,
+	})
+
+	for _, parent := range []string{
+		"socks5://user:pass@" + socksParent,
+		"http://user:pass@" + httpParent,
+	} {
+		forward, err := NewForward(handler, net.JoinHostPort("localhost", port), parent)
+		require.NoError(t, err)
+		assert.Contains(t, forwardGet(t, startForward(t, forward)), "forward", parent)
+	}
+	assert.Equal(t, int32(3), dials.Load())
+
+	// wrong parent credentials
+	forward, err = NewForward(handler, target, "socks5://user:wrong@"+socksParent)
+	require.NoError(t, err)
+	assert.Empty(t, forwardGet(t, startForward(t, forward)))
+}
+
+func TestForwardRules(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	port := strconv.Itoa(origin.Listener.Addr().(*net.TCPAddr).Port)
+
+	handler := newHandler(nil, &rules.ProxyRulesSet{RejectFQDN: []string{"localhost"}})
+	for _, parent := range []string{"", "socks5://127.0.0.1:1"} {
+		forward, err := NewForward(handler, net.JoinHostPort("localhost", port), parent)
+		require.NoError(t, err)
+		assert.Empty(t, forwardGet(t, startForward(t, forward)), parent)
+	}
+
+	_, err := NewForward(handler, "localhost", "")
+	assert.Error(t, err)
+	_, err = NewForward(handler, "localhost:80", "ftp://parent:21")
+	assert.Error(t, err)
+}
+
+func TestForwardScriptRoute(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "forward")
+	}))
+	defer origin.Close()
+	target := origin.Listener.Addr().String()
+
+	credentials := socks5.StaticCredentials{"user": "pass"}
+	var parentDials atomic.Int32
+	parentHandler := newHandler(credentials, socks5.NewPermitAll())
+	parentDial := parentHandler.Dial
+	parentHandler.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		parentDials.Add(1)
+		return parentDial(ctx, network, addr)
+	}
+	socksParent := startServer(t, &Server{
+		Handler: parentHandler,
+		Socks5:  socks5.NewServer(socks5.WithCredential(credentials), socks5.WithDial(parentHandler.Dial)),
+	})
+
+	path := filepath.Join(t.TempDir(), "rules.cel")
+	require.NoError(t, os.WriteFile(path, []byte("parent socks5://user:pass@"+socksParent+" ip == \"127.0.0.1\"\n"+
+		"egress 127.0.0.1 true\n"), 0o644))
+	s, err := script.Load(path)
+	require.NoError(t, err)
+
+	var egress []string
+	handler := newHandler(nil, &rules.ProxyRulesSet{Script: s})
+	handler.EgressDial = func(ip net.IP) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		egress = append(egress, ip.String())
+		return handler.Dial
+	}
+
+	forward, err := NewForward(handler, target, "")
+	require.NoError(t, err)
+	assert.Contains(t, forwardGet(t, startForward(t, forward)), "forward")
+	assert.Equal(t, int32(1), parentDials.Load())
+	assert.Equal(t, []string{"127.0.0.1"}, egress)
+
+	// parent of script overrides parent of forward
+	forward, err = NewForward(handler, target, "socks5://127.0.0.1:1")
+	require.NoError(t, err)
+	assert.Contains(t, forwardGet(t, startForward(t, forward)), "forward")
+	assert.Equal(t, int32(2), parentDials.Load())
+
+	// parent of forward is dialed from egress address of script
+	httpParent := startServer(t, &Server{
+		Handler: newHandler(credentials, socks5.NewPermitAll()),
+		HTTP:    true,
+	})
+	port := strconv.Itoa(origin.Listener.Addr().(*net.TCPAddr).Port)
+	forward, err = NewForward(handler, net.JoinHostPort("localhost", port), "http://user:pass@"+httpParent)
+	require.NoError(t, err)
+	assert.Contains(t, forwardGet(t, startForward(t, forward)), "forward")
+	assert.Equal(t, int32(2), parentDials.Load())
+	assert.Equal(t, []string{"127.0.0.1", "127.0.0.1", "127.0.0.1"}, egress)
+}
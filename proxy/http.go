@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are meaningful only for single connection and not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// serveHTTP handles HTTP proxy requests of client: CONNECT tunnels and
+// plain requests with absolute URI
+func (s *Server) serveHTTP(conn *peekConn) error {
+	defer conn.Close()
+
+	for {
+		req, err := http.ReadRequest(conn.reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("http: read request: %w", err)
+		}
+
+		user, ok := s.authenticateHTTP(req, conn)
+		if !ok {
+			resp := newResponse(req, http.StatusProxyAuthRequired)
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="rgosocks"`)
+			return resp.Write(conn)
+		}
+
+		if req.Method == http.MethodConnect {
+			return s.handleHTTPConnect(conn, req, user)
+		}
+
+		keepAlive, err := s.handleHTTPForward(conn, req, user)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+func newResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     make(http.Header),
+		Close:      true,
+	}
+}
+
+// authenticateHTTP checks client certificate or Proxy-Authorization basic credentials
+func (s *Server) authenticateHTTP(req *http.Request, conn net.Conn) (string, bool) {
+	if user, ok := s.certUser(conn); ok {
+		return user, true
+	}
+
+	if !s.Handler.AuthRequired() {
+		return "", true
+	}
+
+	user, password, ok := (&http.Request{Header: http.Header{
+		"Authorization": req.Header.Values("Proxy-Authorization"),
+	}}).BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	return user, s.Handler.Valid(user, password, conn.RemoteAddr().String())
+}
+
+// dialHTTP resolves, checks and dials host:port of request, returned context
+// holds rules decision
+func (s *Server) dialHTTP(conn net.Conn, req *http.Request, hostPort string, user string) (context.Context, net.Conn, *socks5.Request, int) {
+	dest, err := statute.ParseAddrSpec(hostPort)
+	if err != nil {
+		slog.Debug("HTTP proxy", "host", hostPort, "err", err)
+		return nil, nil, nil, http.StatusBadRequest
+	}
+
+	request := NewRequest(statute.CommandConnect, dest, user, conn.LocalAddr(), conn.RemoteAddr())
+	ctx, target, err := s.Handler.Connect(req.Context(), request)
+	switch {
+	case err == nil:
+		return ctx, target, request, http.StatusOK
+	case errors.Is(err, ErrRuleFailure):
+		slog.Error("HTTP proxy", "method", req.Method, "host", hostPort, "err", err)
+		return nil, nil, nil, http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		slog.Error("HTTP proxy", "method", req.Method, "host", hostPort, "err", err)
+		return nil, nil, nil, http.StatusGatewayTimeout
+	default:
+		slog.Error("HTTP proxy", "method", req.Method, "host", hostPort, "err", err)
+		return nil, nil, nil, http.StatusBadGateway
+	}
+}
+
+func (s *Server) handleHTTPConnect(conn *peekConn, req *http.Request, user string) error {
+	ctx, target, request, status := s.dialHTTP(conn, req, req.Host, user)
+	if target == nil {
+		return newResponse(req, status).Write(conn)
+	}
+	defer target.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return err
+	}
+
+	return s.Handler.Tunnel(ctx, ProtocolHTTP, conn, target, request)
+}
+
+// handleHTTPForward sends request with absolute URI to origin server and
+// returns whether client connection can be reused
+func (s *Server) handleHTTPForward(conn *peekConn, req *http.Request, user string) (bool, error) {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return false, newResponse(req, http.StatusBadRequest).Write(conn)
+	}
+
+	hostPort := req.URL.Host
+	if req.URL.Port() == "" {
+		hostPort = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	_, target, _, status := s.dialHTTP(conn, req, hostPort, user)
+	if target == nil {
+		return false, newResponse(req, status).Write(conn)
+	}
+	defer target.Close()
+
+	clientClose := req.Close
+	removeHopHeaders(req.Header)
+	req.Close = true
+
+	if err := req.Write(target); err != nil {
+		return false, newResponse(req, http.StatusBadGateway).Write(conn)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(target), req)
+	if err != nil {
+		return false, newResponse(req, http.StatusBadGateway).Write(conn)
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+	keepAlive := !clientClose && (resp.ContentLength >= 0 || chunked)
+	resp.Close = !keepAlive
+
+	slog.Debug("HTTP proxy", "method", req.Method, "url", req.URL.String(), "status", resp.StatusCode)
+
+	return keepAlive, resp.Write(conn)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"rgosocks/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+)
+
+func startServer(t *testing.T, server *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(func() { _ = l.Close() })
+
+	return l.Addr().String()
+}
+
+func newHandler(credentials socks5.CredentialStore, ruleSet socks5.RuleSet) *Handler {
+	return &Handler{
+		Credentials: credentials,
+		Rules:       ruleSet,
+		Resolver:    socks5.DNSResolver{},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func proxyClient(proxyAddr string, user *url.Userinfo) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr, User: user}),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return string(body)
+}
+
+func TestHTTPForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	addr := startServer(t, &Server{
+		Handler: newHandler(socks5.StaticCredentials{"user": "pass"}, socks5.NewPermitAll()),
+		HTTP:    true,
+	})
+
+	client := proxyClient(addr, url.UserPassword("user", "pass"))
+	for _, path := range []string{"/one", "/two"} {
+		resp, err := client.Get(origin.URL + path)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello "+path, readBody(t, resp))
+	}
+
+	resp, err := proxyClient(addr, url.UserPassword("user", "wrong")).Get(origin.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	_ = resp.Body.Close()
+}
+
+func TestHTTPConnect(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "secure")
+	}))
+	defer origin.Close()
+
+	addr := startServer(t, &Server{
+		Handler: newHandler(nil, socks5.NewPermitAll()),
+		HTTP:    true,
+	})
+
+	resp, err := proxyClient(addr, nil).Get(origin.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "secure", readBody(t, resp))
+}
+
+func TestHTTPRules(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	_, rejectNet, _ := net.ParseCIDR("127.0.0.0/8")
+	addr := startServer(t, &Server{
+		Handler: newHandler(nil, &rules.ProxyRulesSet{RejectIPNet: []*net.IPNet{rejectNet}}),
+		HTTP:    true,
+	})
+
+	resp, err := proxyClient(addr, nil).Get(origin.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_ = resp.Body.Close()
+}
+
+func TestSniffSocks5(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "sniffed")
+	}))
+	defer origin.Close()
+
+	handler := newHandler(nil, socks5.NewPermitAll())
+	addr := startServer(t, &Server{
+		Handler: handler,
+		Socks5:  socks5.NewServer(socks5.WithDial(handler.Dial)),
+		HTTP:    true,
+	})
+
+	// HTTP client on the same port
+	resp, err := proxyClient(addr, nil).Get(origin.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "sniffed", readBody(t, resp))
+
+	// socks5 client on the same port
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+	_, err = conn.Write([]byte{5, 1, 0})
+	require.NoError(t, err)
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{5, 0}, reply)
+
+	request := []byte{5, 1, 0, 1}
+	request = append(request, originAddr.IP.To4()...)
+	request = append(request, byte(originAddr.Port>>8), byte(originAddr.Port))
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), reply[1])
+}
@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// Certificate fields used as username of client
+const (
+	CertUserCN    = "cn"
+	CertUserEmail = "email"
+	CertUserDNS   = "dns"
+	CertUserURI   = "uri"
+)
+
+var (
+	ErrCertRevoked = errors.New("client certificate revoked")
+	ErrCertNoUser  = errors.New("client certificate has no username")
+	ErrCRLExpired  = errors.New("client CRL expired")
+)
+
+// ClientAuth verifies client certificates issued by CA, checks them against
+// revocation list and maps them to usernames. It also implements
+// socks5.Authenticator for "no authentication" method on TLS connections, so
+// socks5 requests of certificate clients carry username as with password auth.
+type ClientAuth struct {
+	CAs       *x509.CertPool
+	UserField string
+
+	caCerts []*x509.Certificate
+	crlFile string
+
+	mu      sync.RWMutex
+	revoked map[string]struct{}
+	modTime time.Time
+	// nextUpdate is time when CRL expires, zero when CRL has no next update
+	nextUpdate time.Time
+}
+
+// NewClientAuth loads CA certificates and optional CRL file, userField is one of
+// CertUserCN, CertUserEmail, CertUserDNS or CertUserURI
+func NewClientAuth(caFile, crlFile, userField string) (*ClientAuth, error) {
+	switch userField {
+	case CertUserCN, CertUserEmail, CertUserDNS, CertUserURI:
+	default:
+		return nil, fmt.Errorf("unknown certificate user field %q", userField)
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ClientAuth{
+		CAs:       x509.NewCertPool(),
+		UserField: userField,
+		crlFile:   crlFile,
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse CA %s: %w", caFile, err)
+		}
+		a.CAs.AddCert(cert)
+		a.caCerts = append(a.caCerts, cert)
+	}
+	if len(a.caCerts) == 0 {
+		return nil, fmt.Errorf("no CA certificates in %s", caFile)
+	}
+
+	if crlFile != "" {
+		if err := a.loadCRL(fileModTime(crlFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func fileModTime(file string) time.Time {
+	if info, err := os.Stat(file); err == nil {
+		return info.ModTime()
+	}
+
+	return time.Time{}
+}
+
+// loadCRL reads revocation list in PEM or DER form signed by one of CA
+// certificates, expired list is rejected
+func (a *ClientAuth) loadCRL(modTime time.Time) error {
+	data, err := os.ReadFile(a.crlFile)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parse CRL %s: %w", a.crlFile, err)
+	}
+
+	signed := false
+	for _, ca := range a.caCerts {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("CRL %s is not signed by client CA", a.crlFile)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return fmt.Errorf("%w: %s next update %s", ErrCRLExpired, a.crlFile, crl.NextUpdate.Format(time.RFC3339))
+	}
+
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.revoked = revoked
+	a.modTime = modTime
+	a.nextUpdate = crl.NextUpdate
+
+	return nil
+}
+
+// checkRevoked reloads CRL file when it changes and checks serial number of
+// cert, all certificates are rejected when CRL expires until it is updated
+func (a *ClientAuth) checkRevoked(cert *x509.Certificate) error {
+	if a.crlFile == "" {
+		return nil
+	}
+
+	modTime := fileModTime(a.crlFile)
+
+	a.mu.RLock()
+	changed := !modTime.Equal(a.modTime)
+	a.mu.RUnlock()
+
+	if changed {
+		if err := a.loadCRL(modTime); err != nil {
+			// keep previous list until file is fixed
+			slog.Error("Reload client CRL", "crl", a.crlFile, "err", err)
+
+			a.mu.Lock()
+			a.modTime = modTime
+			a.mu.Unlock()
+		} else {
+			slog.Info("Reload client CRL", "crl", a.crlFile)
+		}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.nextUpdate.IsZero() && time.Now().After(a.nextUpdate) {
+		slog.Error("Client CRL expired", "crl", a.crlFile, "nextUpdate", a.nextUpdate)
+		return fmt.Errorf("%w: next update %s", ErrCRLExpired, a.nextUpdate.Format(time.RFC3339))
+	}
+	if _, revoked := a.revoked[cert.SerialNumber.String()]; revoked {
+		return fmt.Errorf("%w: serial %s", ErrCertRevoked, cert.SerialNumber)
+	}
+
+	return nil
+}
+
+// User returns username of client certificate
+func (a *ClientAuth) User(cert *x509.Certificate) string {
+	switch a.UserField {
+	case CertUserEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertUserDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertUserURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
+
+// verifyConnection rejects revoked certificates and certificates without username
+func (a *ClientAuth) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := state.PeerCertificates[0]
+	if err := a.checkRevoked(cert); err != nil {
+		return err
+	}
+	if a.User(cert) == "" {
+		return fmt.Errorf("%w: field %s", ErrCertNoUser, a.UserField)
+	}
+
+	return nil
+}
+
+// Configure requires verified client certificates on TLS connections of
+// config, clients without certificate fail handshake
+func (a *ClientAuth) Configure(config *tls.Config) {
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = a.CAs
+	config.VerifyConnection = a.verifyConnection
+}
+
+// ConnUser returns username of verified client certificate of conn
+func (a *ClientAuth) ConnUser(conn any) (string, bool) {
+	switch c := conn.(type) {
+	case *peekConn:
+		return a.ConnUser(c.Conn)
+	case *tls.Conn:
+		chains := c.ConnectionState().VerifiedChains
+		if len(chains) == 0 || len(chains[0]) == 0 {
+			return "", false
+		}
+		user := a.User(chains[0][0])
+		return user, user != ""
+	}
+
+	return "", false
+}
+
+// GetCode implements socks5.Authenticator
+func (a *ClientAuth) GetCode() uint8 { return statute.MethodNoAuth }
+
+// Authenticate implements socks5.Authenticator, writer is connection of client
+func (a *ClientAuth) Authenticate(_ io.Reader, writer io.Writer, userAddr string) (*socks5.AuthContext, error) {
+	user, ok := a.ConnUser(writer)
+	if !ok {
+		_, _ = writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAcceptable})
+		return nil, statute.ErrUserAuthFailed
+	}
+
+	if _, err := writer.Write([]byte{statute.VersionSocks5, statute.MethodNoAuth}); err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Client certificate", "remote", userAddr, "user", user)
+
+	return &socks5.AuthContext{
+		Method:  statute.MethodNoAuth,
+		Payload: map[string]string{"username": user},
+	}, nil
+}
+
+// ensure ClientAuth can be used as socks5 authentication method
+var _ socks5.Authenticator = (*ClientAuth)(nil)
+
+// certUser returns username of client certificate when listener requires them
+func (s *Server) certUser(conn net.Conn) (string, bool) {
+	if s.ClientAuth == nil {
+		return "", false
+	}
+
+	return s.ClientAuth.ConnUser(conn)
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+)
+
+// userRules permits everything and records usernames of requests
+type userRules struct {
+	mu    sync.Mutex
+	users []string
+}
+
+func (r *userRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.users = append(r.users, req.AuthContext.Payload["username"])
+	return ctx, true
+}
+
+func (r *userRules) Users() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.users...)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T, dir string) (*testCA, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return &testCA{cert: cert, key: key}, caFile
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, emails ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: commonName},
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writeCRL(t *testing.T, file string, number int64, serials ...int64) {
+	ca.writeCRLUntil(t, file, number, time.Now().Add(time.Hour), serials...)
+}
+
+func (ca *testCA) writeCRLUntil(t *testing.T, file string, number int64, nextUpdate time.Time, serials ...int64) {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: nextUpdate.Add(-2 * time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600))
+}
+
+// socks5Connect sends "no authentication" greeting and CONNECT to addr, returns reply code
+func socks5Connect(conn net.Conn, addr *net.TCPAddr) (byte, error) {
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, addr.IP.To4()...)
+	request = binary.BigEndian.AppendUint16(request, uint16(addr.Port))
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, err
+	}
+	if reply[1] != 0 {
+		return 0, fmt.Errorf("method %d not accepted", reply[1])
+	}
+
+	return reply[3], nil
+}
+
+func TestClientCertAuth(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	dir := t.TempDir()
+	ca, caFile := newTestCA(t, dir)
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlFile, 1, 11)
+
+	clientAuth, err := NewClientAuth(caFile, crlFile, CertUserCN)
+	require.NoError(t, err)
+
+	certFile, keyFile := writeCert(t, dir, "server")
+	certs, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	config := certs.TLSConfig()
+	clientAuth.Configure(config)
+
+	ruleSet := new(userRules)
+	credentials := socks5.StaticCredentials{"user": "pass"}
+	addr := startTLSServer(t, &Server{
+		Handler:           newHandler(credentials, ruleSet),
+		Socks5:            socks5.NewServer(socks5.WithAuthMethods([]socks5.Authenticator{clientAuth}), socks5.WithRule(ruleSet)),
+		Socks4:            true,
+		Socks4CheckUserId: true,
+		ClientAuth:        clientAuth,
+	}, config)
+
+	dial := func(certs ...tls.Certificate) net.Conn {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+
+	alice := ca.issue(t, 10, "alice")
+	status, err := socks5Connect(dial(alice), originAddr)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), status)
+
+	// socks4 clients with certificate do not need userid
+	conn := dial(alice)
+	_, err = conn.Write(binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(originAddr.Port)))
+	require.NoError(t, err)
+	_, err = conn.Write(append(originAddr.IP.To4(), 0))
+	require.NoError(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, socks4Granted, reply[1])
+
+	assert.Equal(t, []string{"alice", "alice"}, ruleSet.Users())
+
+	// revoked certificate
+	_, err = socks5Connect(dial(ca.issue(t, 11, "bob")), originAddr)
+	assert.Error(t, err)
+
+	// no certificate
+	_, err = socks5Connect(dial(), originAddr)
+	assert.Error(t, err)
+
+	// updated CRL revokes alice and releases bob
+	ca.writeCRL(t, crlFile, 2, 10)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(crlFile, future, future))
+
+	_, err = socks5Connect(dial(alice), originAddr)
+	assert.Error(t, err)
+	status, err = socks5Connect(dial(ca.issue(t, 11, "bob")), originAddr)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), status)
+	assert.Equal(t, []string{"alice", "alice", "bob"}, ruleSet.Users())
+}
+
+func TestClientCRLExpired(t *testing.T) {
+	dir := t.TempDir()
+	ca, caFile := newTestCA(t, dir)
+	crlFile := filepath.Join(dir, "ca.crl")
+	ca.writeCRLUntil(t, crlFile, 1, time.Now().Add(-time.Minute))
+
+	_, err := NewClientAuth(caFile, crlFile, CertUserCN)
+	assert.ErrorIs(t, err, ErrCRLExpired)
+
+	ca.writeCRL(t, crlFile, 2)
+	clientAuth, err := NewClientAuth(caFile, crlFile, CertUserCN)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(ca.issue(t, 10, "alice").Certificate[0])
+	require.NoError(t, err)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	assert.NoError(t, clientAuth.verifyConnection(state))
+
+	// CRL expires while it is loaded
+	clientAuth.nextUpdate = time.Now().Add(-time.Second)
+	assert.ErrorIs(t, clientAuth.verifyConnection(state), ErrCRLExpired)
+}
+
+func TestClientCertUser(t *testing.T) {
+	dir := t.TempDir()
+	ca, caFile := newTestCA(t, dir)
+	cert := ca.issue(t, 10, "alice", "alice@example.com")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	for field, user := range map[string]string{
+		CertUserCN:    "alice",
+		CertUserEmail: "alice@example.com",
+		CertUserDNS:   "",
+	} {
+		clientAuth, err := NewClientAuth(caFile, "", field)
+		require.NoError(t, err)
+		assert.Equal(t, user, clientAuth.User(leaf), field)
+	}
+
+	_, err = NewClientAuth(caFile, "", "serial")
+	assert.Error(t, err)
+
+	// CRL signed by other CA is rejected
+	other, _ := newTestCA(t, t.TempDir())
+	crlFile := filepath.Join(dir, "other.crl")
+	other.writeCRL(t, crlFile, 1, 10)
+	_, err = NewClientAuth(caFile, crlFile, CertUserCN)
+	assert.Error(t, err)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// ParseParent parses parent proxy URL: socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port
+func ParseParent(rawURL string) (*url.URL, error) {
+	parent, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parent.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, fmt.Errorf("unsupported parent proxy scheme %q", parent.Scheme)
+	}
+	if parent.Port() == "" {
+		return nil, fmt.Errorf("parent proxy %s has no port", parent.Redacted())
+	}
+
+	return parent, nil
+}
+
+// DialParent connects to dest through parent proxy, connection to parent is made by dial
+func DialParent(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error),
+	parent *url.URL, dest statute.AddrSpec) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", parent.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// handshake is bounded by context deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	var target net.Conn
+	if parent.Scheme == "http" {
+		target, err = connectHTTPParent(conn, parent, dest)
+	} else {
+		err = connectSocks5Parent(conn, parent, dest)
+		target = conn
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("parent %s: %w", parent.Redacted(), err)
+	}
+
+	return target, nil
+}
+
+func connectSocks5Parent(conn net.Conn, parent *url.URL, dest statute.AddrSpec) error {
+	methods := []byte{statute.MethodNoAuth}
+	if parent.User != nil {
+		methods = []byte{statute.MethodUserPassAuth}
+	}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, methods).Bytes()); err != nil {
+		return err
+	}
+
+	method, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return err
+	}
+
+	switch method.Method {
+	case statute.MethodNoAuth:
+	case statute.MethodUserPassAuth:
+		password, _ := parent.User.Password()
+		request := statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte(parent.User.Username()), []byte(password))
+		if _, err := conn.Write(request.Bytes()); err != nil {
+			return err
+		}
+		reply, err := statute.ParseUserPassReply(conn)
+		if err != nil {
+			return err
+		}
+		if reply.Status != statute.AuthSuccess {
+			return statute.ErrUserAuthFailed
+		}
+	default:
+		return statute.ErrNoSupportedAuth
+	}
+
+	if dest.FQDN != "" {
+		dest = statute.AddrSpec{FQDN: dest.FQDN, Port: dest.Port, AddrType: statute.ATYPDomain}
+	} else if dest.IP.To4() != nil {
+		dest.AddrType = statute.ATYPIPv4
+	} else {
+		dest.AddrType = statute.ATYPIPv6
+	}
+
+	request := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: dest,
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return err
+	}
+
+	reply, err := statute.ParseReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply.Response != statute.RepSuccess {
+		return fmt.Errorf("connect to %s: reply %d", dest.Address(), reply.Response)
+	}
+
+	return nil
+}
+
+func connectHTTPParent(conn net.Conn, parent *url.URL, dest statute.AddrSpec) (net.Conn, error) {
+	hostPort := dest.String()
+	if dest.FQDN != "" {
+		hostPort = net.JoinHostPort(dest.FQDN, strconv.Itoa(dest.Port))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostPort},
+		Host:   hostPort,
+		Header: make(http.Header),
+	}
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(parent.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	// response is read through buffer of returned connection, so bytes
+	// sent by destination right after response are not lost
+	c := newPeekConn(conn)
+	resp, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("connect to %s: %s", hostPort, resp.Status)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"net"
+	"net/url"
+	"rgosocks/geoip"
+	"rgosocks/rules"
+	"time"
+)
+
+var (
+	ErrRuleFailure     = errors.New("blocked by rules")
+	ErrHostUnreachable = errors.New("host unreachable")
+)
+
+// Handler holds components shared by every inbound protocol, so HTTP and
+// other non socks5 clients are served with the same credentials, rules,
+// resolver and dial as socks5 server.
+type Handler struct {
+	// Credentials is nil when proxy does not require authentication
+	Credentials socks5.CredentialStore
+	Rules       socks5.RuleSet
+	Resolver    socks5.NameResolver
+	Dial        func(ctx context.Context, network, addr string) (net.Conn, error)
+	// EgressDial returns dial from local address selected by rules, nil
+	// ignores egress address of rules
+	EgressDial func(ip net.IP) func(ctx context.Context, network, addr string) (net.Conn, error)
+	// SniffTimeout enables checking hostname from TLS SNI or HTTP Host of
+	// tunnels requested by IP against rules
+	SniffTimeout time.Duration
+	// Conns registers active tunnels, nil disables connection table
+	Conns *ConnTable
+	// UDP holds settings of socks5 UDP ASSOCIATE, nil uses defaults
+	UDP *UDPRelay
+	// Bind holds settings of socks5 BIND, nil uses defaults
+	Bind *BindRelay
+	// GeoIP adds country and ASN of destination to connection table and
+	// tunnel log when rules decision does not carry them, nil disables lookups
+	GeoIP *geoip.DB
+}
+
+// NewRequest builds request of command to dest as socks5 server does after handshake
+func NewRequest(command byte, dest statute.AddrSpec, user string, local, remote net.Addr) *socks5.Request {
+	authContext := &socks5.AuthContext{
+		Method:  statute.MethodNoAuth,
+		Payload: map[string]string{},
+	}
+	if user != "" {
+		authContext.Method = statute.MethodUserPassAuth
+		authContext.Payload["username"] = user
+	}
+
+	return &socks5.Request{
+		Request: statute.Request{
+			Version: statute.VersionSocks5,
+			Command: command,
+			DstAddr: dest,
+		},
+		AuthContext: authContext,
+		LocalAddr:   local,
+		RemoteAddr:  remote,
+		RawDestAddr: &dest,
+	}
+}
+
+// Valid checks user credentials, any user is valid when authentication is disabled
+func (h *Handler) Valid(user, password, userAddr string) bool {
+	return h.Credentials == nil || h.Credentials.Valid(user, password, userAddr)
+}
+
+// AuthRequired reports whether clients must provide credentials
+func (h *Handler) AuthRequired() bool {
+	return h.Credentials != nil
+}
+
+// Allow resolves destination FQDN of req and checks it against rules
+func (h *Handler) Allow(ctx context.Context, req *socks5.Request) (context.Context, error) {
+	var err error
+
+	dest := req.RawDestAddr
+	if dest.FQDN != "" {
+		ctx, dest.IP, err = h.Resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return ctx, fmt.Errorf("%w: resolve %s: %v", ErrHostUnreachable, dest.FQDN, err)
+		}
+		if dest.IP == nil {
+			return ctx, fmt.Errorf("%w: resolve %s: no address", ErrHostUnreachable, dest.FQDN)
+		}
+	}
+	req.DestAddr = dest
+
+	return h.Check(ctx, req)
+}
+
+// Check applies rules to destination of req without resolving it, FQDN
+// destination is checked by FQDN rules only
+func (h *Handler) Check(ctx context.Context, req *socks5.Request) (context.Context, error) {
+	return h.check(ctx, req, h.Rules.Allow)
+}
+
+// recheck applies rules again to request already allowed by Check, rules
+// supporting it are not counted twice
+func (h *Handler) recheck(ctx context.Context, req *socks5.Request) (context.Context, error) {
+	if rechecker, ok := h.Rules.(rules.Rechecker); ok {
+		return h.check(ctx, req, rechecker.Recheck)
+	}
+	return h.check(ctx, req, h.Rules.Allow)
+}
+
+func (h *Handler) check(ctx context.Context, req *socks5.Request,
+	allow func(context.Context, *socks5.Request) (context.Context, bool)) (context.Context, error) {
+	if req.DestAddr == nil {
+		req.DestAddr = req.RawDestAddr
+	}
+
+	var ok bool
+	ctx, ok = allow(ctx, req)
+	if !ok {
+		if decision, found := rules.DecisionFromContext(ctx); found {
+			return ctx, fmt.Errorf("%w: %s: %s", ErrRuleFailure, req.DestAddr.Address(), decision)
+		}
+		return ctx, fmt.Errorf("%w: %s", ErrRuleFailure, req.DestAddr.Address())
+	}
+
+	return ctx, nil
+}
+
+// Connect applies resolver and rules to CONNECT request and dials destination,
+// returned context holds rules decision for Tunnel
+func (h *Handler) Connect(ctx context.Context, req *socks5.Request) (context.Context, net.Conn, error) {
+	ctx, err := h.Allow(ctx, req)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	target, err := h.dialRoute(ctx, req, nil)
+	return ctx, target, err
+}
+
+// dialRoute connects to destination of req by route of rules decision in
+// ctx: through parent proxy, from egress address or directly by Dial. Parent
+// of decision overrides parent, nil parent connects directly.
+func (h *Handler) dialRoute(ctx context.Context, req *socks5.Request, parent *url.URL) (net.Conn, error) {
+	dial := h.Dial
+	decision, _ := rules.DecisionFromContext(ctx)
+	if decision.Egress != nil && h.EgressDial != nil {
+		dial = h.EgressDial(decision.Egress)
+	}
+	if decision.Parent != nil {
+		parent = decision.Parent
+	}
+	if parent != nil {
+		return DialParent(ctx, dial, parent, *req.RawDestAddr)
+	}
+
+	return dial(ctx, "tcp", req.DestAddr.String())
+}
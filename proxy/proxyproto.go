@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout limits time of reading PROXY protocol header
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLength is maximum length of v1 header including CRLF
+	proxyV1MaxLength = 107
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyProtoListener reads PROXY protocol header of connections accepted from
+// trusted balancers, connections of other peers are returned as is
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtoListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	if len(trusted) == 0 {
+		return l
+	}
+
+	return &proxyProtoListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn, nil
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+		}
+	}
+
+	return conn, nil
+}
+
+// proxyProtoConn reads header on first use, so Accept is not blocked by slow
+// clients. Header is required, connection without it fails.
+type proxyProtoConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.local, c.err = readProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns client address from header
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns destination address from header
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local != nil {
+		return c.local
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// socketLocalAddr returns local address of socket under conn wrappers, it is
+// address of this host for binding relay sockets. LocalAddr of PROXY protocol
+// connection is destination from header, which belongs to balancer.
+func socketLocalAddr(conn net.Conn) net.Addr {
+	for {
+		switch c := conn.(type) {
+		case *proxyProtoConn:
+			return c.Conn.LocalAddr()
+		case *peekConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return conn.LocalAddr()
+		}
+	}
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// readProxyHeader reads PROXY protocol v1 or v2 header, nil addresses mean
+// that balancer sent header of its own connection (UNKNOWN or LOCAL)
+func readProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	head, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	if bytes.Equal(head, proxyV1Prefix) {
+		return readProxyHeaderV1(r)
+	}
+	if bytes.Equal(head, proxyV2Signature[:len(head)]) {
+		return readProxyHeaderV2(r)
+	}
+
+	return nil, nil, fmt.Errorf("%w: no header", ErrProxyHeader)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, nil, fmt.Errorf("%w: v1 header too long", ErrProxyHeader)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+
+	src, srcErr := parseProxyAddr(fields[2], fields[4])
+	dst, dstErr := parseProxyAddr(fields[3], fields[5])
+	if srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: v2 signature", ErrProxyHeader)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+	}
+
+	switch header[12] & 0x0f {
+	case 0x00: // LOCAL
+		return nil, nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("%w: v2 command %d", ErrProxyHeader, header[12]&0x0f)
+	}
+
+	// address family and protocol, TLVs after addresses are ignored
+	var ipLen int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("%w: v2 address length", ErrProxyHeader)
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+
+	return src, dst, nil
+}
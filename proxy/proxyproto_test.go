@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// remoteRules permits everything and records client addresses of requests
+type remoteRules struct {
+	mu      sync.Mutex
+	remotes []string
+}
+
+func (r *remoteRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remotes = append(r.remotes, req.RemoteAddr.String())
+	return ctx, true
+}
+
+func (r *remoteRules) Remotes() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.remotes...)
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, src.IP.To4()...)
+	header = append(header, dst.IP.To4()...)
+	header = binary.BigEndian.AppendUint16(header, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(header, uint16(dst.Port))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		remote string
+		local  string
+		err    bool
+	}{
+		{name: "v1 tcp4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n", remote: "192.0.2.1:56324", local: "198.51.100.1:1080"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 1080\r\n", remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:1080"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 bad address", header: "PROXY TCP4 host 198.51.100.1 56324 1080\r\n", err: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", err: true},
+		{
+			name: "v2 tcp4",
+			header: string(proxyHeaderV2(
+				&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324},
+				&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1080},
+			)),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:1080",
+		},
+		{name: "v2 local", header: string(proxyV2Signature) + "\x20\x00\x00\x00"},
+		{name: "no header", header: "\x05\x01\x00\x00\x00\x00", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "payload"))
+			remote, local, err := readProxyHeader(r)
+			if tt.err {
+				assert.ErrorIs(t, err, ErrProxyHeader)
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.remote == "" {
+				assert.Nil(t, remote)
+				assert.Nil(t, local)
+			} else {
+				assert.Equal(t, tt.remote, remote.String())
+				assert.Equal(t, tt.local, local.String())
+			}
+
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, "payload", string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ruleSet := new(remoteRules)
+	server := &Server{
+		Handler: newHandler(nil, ruleSet),
+		Socks5:  socks5.NewServer(socks5.WithRule(ruleSet)),
+		Socks4:  true,
+	}
+	go func() { _ = server.Serve(newProxyProtoListener(l, []*net.IPNet{loopback})) }()
+	t.Cleanup(func() { _ = l.Close() })
+
+	client := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 40000}
+
+	// socks5 client behind balancer using v2 header
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(proxyHeaderV2(client, l.Addr().(*net.TCPAddr)))
+	require.NoError(t, err)
+	status, err := socks5Connect(conn, originAddr)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), status)
+
+	// socks4 client behind balancer using v1 header
+	conn4, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn4.Close()
+	_, err = io.WriteString(conn4, "PROXY TCP4 203.0.113.8 127.0.0.1 40001 1080\r\n")
+	require.NoError(t, err)
+	request := binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(originAddr.Port))
+	request = append(request, originAddr.IP.To4()...)
+	_, err = conn4.Write(append(request, 0))
+	require.NoError(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn4, reply)
+	require.NoError(t, err)
+	assert.Equal(t, socks4Granted, reply[1])
+
+	assert.Equal(t, []string{"203.0.113.7:40000", "203.0.113.8:40001"}, ruleSet.Remotes())
+
+	// trusted peer without header is rejected
+	bare, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer bare.Close()
+	_, err = socks5Connect(bare, originAddr)
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolAssociate(t *testing.T) {
+	echo := startUDPEcho(t, net.IPv4(127, 0, 0, 1))
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	credentials := socks5.StaticCredentials{"user": "pass"}
+	handler := newHandler(credentials, socks5.NewPermitAll())
+	server := &Server{
+		Handler: handler,
+		Socks5: socks5.NewServer(
+			socks5.WithCredential(credentials),
+			socks5.WithAssociateHandle(handler.Socks5Associate),
+		),
+	}
+	go func() { _ = server.Serve(newProxyProtoListener(l, []*net.IPNet{loopback})) }()
+	t.Cleanup(func() { _ = l.Close() })
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer client.Close()
+
+	// destination of header is address of balancer, which is not local
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	balancer := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1080}
+	_, err = conn.Write(proxyHeaderV2(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, balancer))
+	require.NoError(t, err)
+	require.Equal(t, byte(0), socks5Handshake(t, conn, "user", "pass"))
+
+	_, err = conn.Write([]byte{5, statute.CommandAssociate, 0, 1, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, statute.RepSuccess, reply[1])
+
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+	assert.Equal(t, "127.0.0.1", relay.IP.String())
+	data, err := udpExchange(t, client, relay, echo, "ping")
+	require.NoError(t, err)
+	assert.Equal(t, "ping", data)
+}
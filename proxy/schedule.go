@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"rgosocks/schedule"
+	"time"
+)
+
+// ScheduleCheckInterval is how often tunnels are checked by schedules, so
+// tunnels are cut within this time after window closes
+const ScheduleCheckInterval = 10 * time.Second
+
+// CutSchedules closes tunnels of users outside of their schedules with cut
+// every interval until ctx is done
+func CutSchedules(ctx context.Context, conns *ConnTable, schedules schedule.Schedules, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cutSchedules(conns, schedules, now)
+		}
+	}
+}
+
+func cutSchedules(conns *ConnTable, schedules schedule.Schedules, now time.Time) int {
+	count := conns.Close(func(info ConnInfo) bool {
+		return schedules.Cut(info.User, now)
+	})
+	if count > 0 {
+		slog.Info("Schedule closed connections", "count", count)
+	}
+
+	return count
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"rgosocks/schedule"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCutSchedules(t *testing.T) {
+	businessHours, err := schedule.Parse([]string{"alice"}, nil, []string{"09:00-18:00"}, "UTC", true)
+	require.NoError(t, err)
+	schedules := schedule.Schedules{businessHours}
+
+	conns := NewConnTable()
+	aliceClient, aliceTarget := net.Pipe()
+	bobClient, bobTarget := net.Pipe()
+	defer bobClient.Close()
+	conns.Add(ConnInfo{User: "alice"}, aliceClient, aliceTarget)
+	conns.Add(ConnInfo{User: "bob"}, bobClient, bobTarget)
+
+	assert.Equal(t, 0, cutSchedules(conns, schedules, time.Date(2026, 10, 19, 17, 59, 0, 0, time.UTC)))
+	assert.Equal(t, 1, cutSchedules(conns, schedules, time.Date(2026, 10, 19, 18, 0, 0, 0, time.UTC)))
+
+	_, err = aliceClient.Write([]byte{1})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	go func() { _, _ = bobTarget.Read(make([]byte, 1)) }()
+	_, err = bobClient.Write([]byte{1})
+	assert.NoError(t, err)
+}
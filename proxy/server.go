@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// Server accepts connections of several proxy protocols on one listener and
+// detects protocol by the first byte sent by client
+type Server struct {
+	Handler *Handler
+	// Socks5 serves socks5 clients, nil disables socks5 on listener
+	Socks5 *socks5.Server
+	// HTTP enables HTTP proxy on listener
+	HTTP bool
+	// Socks4 enables SOCKS4 and SOCKS4a on listener
+	Socks4 bool
+	// Socks4CheckUserId requires SOCKS4 userid "user:password" matching
+	// credentials, without it SOCKS4 clients of listener requiring
+	// authentication are rejected
+	Socks4CheckUserId bool
+	// ClientAuth maps verified client certificates of TLS listener to usernames,
+	// certificate clients are authenticated without password
+	ClientAuth *ClientAuth
+	// ProxyProtocol lists networks of balancers required to send PROXY protocol
+	// header with real client address, empty disables PROXY protocol
+	ProxyProtocol []*net.IPNet
+}
+
+// listen creates listener of network, stale unix socket left by previous
+// process is removed before listening
+func (s *Server) listen(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if info, err := os.Stat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(addr)
+		}
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProxyProtoListener(l, s.ProxyProtocol), nil
+}
+
+// ListenAndServe is used to create a listener and serve on it
+func (s *Server) ListenAndServe(network, addr string) error {
+	l, err := s.listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS is used to create a TLS listener and serve on it
+func (s *Server) ListenAndServeTLS(network, addr string, config *tls.Config) error {
+	l, err := s.listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// Serve is used to serve connections from a listener
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				slog.Error("Serve", "remote", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+// ServeConn is used to serve a single connection
+func (s *Server) ServeConn(conn net.Conn) error {
+	c := newPeekConn(conn)
+
+	head, err := c.Peek(1)
+	if err != nil {
+		_ = conn.Close()
+		if errors.Is(err, ErrProxyHeader) {
+			return err
+		}
+		return nil
+	}
+
+	switch {
+	case head[0] == statute.VersionSocks5 && s.Socks5 != nil:
+		return s.Socks5.ServeConn(c)
+	case head[0] == socks4Version && s.Socks4:
+		return s.serveSocks4(c)
+	case s.HTTP:
+		return s.serveHTTP(c)
+	}
+
+	_ = conn.Close()
+	return statute.ErrNotSupportVersion
+}
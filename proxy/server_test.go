@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+)
+
+func TestListenUnix(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "unix")
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	socket := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// stale socket of previous process
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	server := &Server{
+		Handler: newHandler(nil, socks5.NewPermitAll()),
+		Socks4:  true,
+	}
+	go func() { _ = server.ListenAndServe("unix", socket) }()
+
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		conn, err = net.Dial("unix", socket)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	defer conn.Close()
+
+	request := binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(originAddr.Port))
+	request = append(request, originAddr.IP.To4()...)
+	_, err = conn.Write(append(request, 0))
+	require.NoError(t, err)
+
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, socks4Granted, reply[1])
+	assert.Contains(t, httpGet(t, conn), "unix")
+}
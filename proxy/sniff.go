@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	tlsRecordHandshake = byte(0x16)
+	tlsRecordHeaderLen = 5
+)
+
+var errSniffDone = errors.New("sniff done")
+
+// sniffHost waits up to timeout for first bytes of client and returns hostname
+// from TLS ClientHello SNI or HTTP Host header. Data is only peeked, so it is
+// still sent to destination. Empty result means that hostname is unknown.
+func sniffHost(conn *peekConn, timeout time.Duration) string {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	head, err := conn.Peek(1)
+	if err != nil {
+		return ""
+	}
+
+	var host string
+	if head[0] == tlsRecordHandshake {
+		host = sniffSNI(conn.reader)
+	} else {
+		host = sniffHTTPHost(conn.reader)
+	}
+
+	// addresses are not hostnames, destination IP is already known
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// sniffSNI parses ClientHello of first TLS record by crypto/tls
+func sniffSNI(r *bufio.Reader) string {
+	header, err := r.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return ""
+	}
+
+	length := min(tlsRecordHeaderLen+int(binary.BigEndian.Uint16(header[3:])), r.Size())
+	record, err := r.Peek(length)
+	if err != nil && len(record) == 0 {
+		return ""
+	}
+
+	var host string
+	_ = tls.Server(sniffConn{Reader: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			host = hello.ServerName
+			return nil, errSniffDone
+		},
+	}).Handshake()
+
+	return host
+}
+
+// sniffHTTPHost reads Host header of HTTP request, waiting for more data until
+// headers are complete or buffer is full
+func sniffHTTPHost(r *bufio.Reader) string {
+	for {
+		data, err := r.Peek(r.Buffered())
+		if err != nil {
+			return ""
+		}
+
+		if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+			return parseHTTPHost(data[:end+4])
+		}
+		if len(data) >= r.Size() {
+			return ""
+		}
+
+		// wait for next bytes of request
+		if _, err := r.Peek(len(data) + 1); err != nil {
+			return ""
+		}
+	}
+}
+
+func parseHTTPHost(headers []byte) string {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(headers)))
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return ""
+	}
+	if fields := strings.Fields(line); len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return ""
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+
+	host := header.Get("Host")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return host
+}
+
+// sniffConn feeds peeked bytes to TLS server, handshake stops before any write
+type sniffConn struct {
+	io.Reader
+	net.Conn
+}
+
+func (c sniffConn) Read(b []byte) (int, error)  { return c.Reader.Read(b) }
+func (c sniffConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c sniffConn) Close() error                { return nil }
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sniffPipe writes data of client to pipe and sniffs hostname on server side
+func sniffPipe(t *testing.T, client func(conn net.Conn)) (string, *peekConn) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	})
+
+	go client(clientConn)
+
+	conn := newPeekConn(serverConn)
+	return sniffHost(conn, 200*time.Millisecond), conn
+}
+
+func TestSniffHost(t *testing.T) {
+	t.Run("tls", func(t *testing.T) {
+		host, conn := sniffPipe(t, func(conn net.Conn) {
+			_ = tls.Client(conn, &tls.Config{ServerName: "Example.COM"}).Handshake()
+		})
+		assert.Equal(t, "example.com", host)
+
+		// ClientHello is still available for destination
+		head, err := conn.Peek(1)
+		require.NoError(t, err)
+		assert.Equal(t, tlsRecordHandshake, head[0])
+	})
+
+	t.Run("tls without sni", func(t *testing.T) {
+		host, _ := sniffPipe(t, func(conn net.Conn) {
+			_ = tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		})
+		assert.Empty(t, host)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		request := "GET / HTTP/1.1\r\nHost: www.example.org:8080\r\nAccept: */*\r\n\r\n"
+		host, conn := sniffPipe(t, func(conn net.Conn) {
+			// headers split between writes
+			_, _ = io.WriteString(conn, request[:20])
+			_, _ = io.WriteString(conn, request[20:])
+		})
+		assert.Equal(t, "www.example.org", host)
+
+		data, err := io.ReadAll(io.LimitReader(conn, int64(len(request))))
+		require.NoError(t, err)
+		assert.Equal(t, request, string(data))
+	})
+
+	t.Run("ip host", func(t *testing.T) {
+		host, _ := sniffPipe(t, func(conn net.Conn) {
+			_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: 192.0.2.1\r\n\r\n")
+		})
+		assert.Empty(t, host)
+	})
+
+	t.Run("server first protocol", func(t *testing.T) {
+		start := time.Now()
+		host, _ := sniffPipe(t, func(conn net.Conn) {})
+		assert.Empty(t, host)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		host, _ := sniffPipe(t, func(conn net.Conn) {
+			_, _ = conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+		})
+		assert.Empty(t, host)
+	})
+}
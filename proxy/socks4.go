@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+const (
+	socks4Version = byte(0x04)
+
+	socks4CommandConnect = byte(0x01)
+
+	socks4Granted        = byte(90)
+	socks4Rejected       = byte(91)
+	socks4UserIdMismatch = byte(93)
+
+	// socks4MaxField limits length of userid and hostname fields
+	socks4MaxField = 255
+)
+
+var errSocks4FieldTooLong = errors.New("socks4: field too long")
+
+// socks4Request is CONNECT or BIND request of SOCKS4/SOCKS4a client
+type socks4Request struct {
+	Command byte
+	UserId  string
+	Dest    statute.AddrSpec
+}
+
+func readSocks4String(r *bufio.Reader) (string, error) {
+	var buf bytes.Buffer
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return buf.String(), nil
+		}
+		if buf.Len() >= socks4MaxField {
+			return "", errSocks4FieldTooLong
+		}
+		buf.WriteByte(b)
+	}
+}
+
+func parseSocks4Request(r *bufio.Reader) (*socks4Request, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks4Version {
+		return nil, statute.ErrNotSupportVersion
+	}
+
+	req := &socks4Request{
+		Command: header[1],
+		Dest: statute.AddrSpec{
+			Port:     int(binary.BigEndian.Uint16(header[2:4])),
+			IP:       net.IPv4(header[4], header[5], header[6], header[7]),
+			AddrType: statute.ATYPIPv4,
+		},
+	}
+
+	var err error
+	if req.UserId, err = readSocks4String(r); err != nil {
+		return nil, err
+	}
+
+	// SOCKS4a: address 0.0.0.x with non-zero x means hostname follows userid
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		if req.Dest.FQDN, err = readSocks4String(r); err != nil {
+			return nil, err
+		}
+		req.Dest.IP = nil
+		req.Dest.AddrType = statute.ATYPDomain
+	}
+
+	return req, nil
+}
+
+func sendSocks4Reply(w io.Writer, status byte, addr net.Addr) error {
+	reply := make([]byte, 8)
+	reply[1] = status
+
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && status == socks4Granted {
+		binary.BigEndian.PutUint16(reply[2:4], uint16(tcpAddr.Port))
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			copy(reply[4:], ip4)
+		}
+	}
+
+	_, err := w.Write(reply)
+	return err
+}
+
+// authenticateSocks4 checks client certificate or userid of request in form
+// "user:password" against credentials. Userid is the only credential of
+// SOCKS4, so listener requiring authentication rejects clients without
+// certificate when PROXY_SOCKS4_CHECK_USERID is disabled.
+func (s *Server) authenticateSocks4(userId string, conn net.Conn) (string, bool) {
+	if user, ok := s.certUser(conn); ok {
+		return user, true
+	}
+
+	if !s.Handler.AuthRequired() {
+		return "", true
+	}
+	if !s.Socks4CheckUserId {
+		return "", false
+	}
+
+	user, password, _ := strings.Cut(userId, ":")
+	return user, s.Handler.Valid(user, password, conn.RemoteAddr().String())
+}
+
+// serveSocks4 handles SOCKS4 and SOCKS4a clients. Only CONNECT command is supported.
+func (s *Server) serveSocks4(conn *peekConn) error {
+	defer conn.Close()
+
+	req, err := parseSocks4Request(conn.reader)
+	if err != nil {
+		return fmt.Errorf("socks4: read request: %w", err)
+	}
+
+	user, ok := s.authenticateSocks4(req.UserId, conn)
+	if !ok {
+		_ = sendSocks4Reply(conn, socks4UserIdMismatch, nil)
+		return fmt.Errorf("socks4: %w", statute.ErrUserAuthFailed)
+	}
+
+	if req.Command != socks4CommandConnect {
+		_ = sendSocks4Reply(conn, socks4Rejected, nil)
+		return fmt.Errorf("socks4: unsupported command[%d]", req.Command)
+	}
+
+	ctx := context.Background()
+	request := NewRequest(statute.CommandConnect, req.Dest, user, conn.LocalAddr(), conn.RemoteAddr())
+	ctx, target, err := s.Handler.Connect(ctx, request)
+	if err != nil {
+		_ = sendSocks4Reply(conn, socks4Rejected, nil)
+		return fmt.Errorf("socks4: connect to %s: %w", req.Dest.Address(), err)
+	}
+	defer target.Close()
+
+	if err := sendSocks4Reply(conn, socks4Granted, target.LocalAddr()); err != nil {
+		return err
+	}
+
+	slog.Debug("Socks4 connect", "remote", conn.RemoteAddr(), "dest", request.DestAddr.Address())
+
+	return s.Handler.Tunnel(ctx, ProtocolSocks4, conn, target, request)
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+)
+
+// socks4Connect sends SOCKS4 CONNECT to ip:port, or SOCKS4a when host is not empty
+func socks4Connect(t *testing.T, proxyAddr string, ip net.IP, host string, port int, userId string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+
+	request := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(request[2:], uint16(port))
+	if host != "" {
+		ip = net.IPv4(0, 0, 0, 1)
+	}
+	request = append(request, ip.To4()...)
+	request = append(request, userId...)
+	request = append(request, 0)
+	if host != "" {
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), reply[0])
+
+	return conn, reply[1]
+}
+
+func httpGet(t *testing.T, conn net.Conn) string {
+	_, err := io.WriteString(conn, "GET / HTTP/1.0\r\nHost: origin\r\n\r\n")
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	return string(body)
+}
+
+func TestSocks4(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "socks4")
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	addr := startServer(t, &Server{
+		Handler: newHandler(nil, socks5.NewPermitAll()),
+		Socks4:  true,
+	})
+
+	conn, status := socks4Connect(t, addr, originAddr.IP, "", originAddr.Port, "")
+	defer conn.Close()
+	require.Equal(t, socks4Granted, status)
+	assert.Contains(t, httpGet(t, conn), "socks4")
+
+	conn4a, status := socks4Connect(t, addr, nil, "localhost", originAddr.Port, "anyone")
+	defer conn4a.Close()
+	require.Equal(t, socks4Granted, status)
+	assert.Contains(t, httpGet(t, conn4a), "socks4")
+}
+
+func TestSocks4UserId(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	credentials := socks5.StaticCredentials{"user": "pass"}
+	addr := startServer(t, &Server{
+		Handler:           newHandler(credentials, socks5.NewPermitAll()),
+		Socks4:            true,
+		Socks4CheckUserId: true,
+	})
+
+	conn, status := socks4Connect(t, addr, originAddr.IP, "", originAddr.Port, "user:wrong")
+	_ = conn.Close()
+	assert.Equal(t, socks4UserIdMismatch, status)
+
+	conn, status = socks4Connect(t, addr, originAddr.IP, "", originAddr.Port, "user:pass")
+	_ = conn.Close()
+	assert.Equal(t, socks4Granted, status)
+
+	// listener requiring authentication does not accept unchecked userid
+	addr = startServer(t, &Server{
+		Handler: newHandler(credentials, socks5.NewPermitAll()),
+		Socks4:  true,
+	})
+	conn, status = socks4Connect(t, addr, originAddr.IP, "", originAddr.Port, "user:pass")
+	_ = conn.Close()
+	assert.Equal(t, socks4UserIdMismatch, status)
+}
+
+func TestSocks4Disabled(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: newHandler(nil, socks5.NewPermitAll()),
+		Socks5:  socks5.NewServer(),
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{4, 1, 0, 80, 127, 0, 0, 1, 0})
+	require.NoError(t, err)
+
+	_, err = conn.Read(make([]byte, 8))
+	assert.ErrorIs(t, err, io.EOF)
+}
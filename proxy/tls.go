@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves certificate loaded from files and reloads it when
+// modification time of certificate or key file changes
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads certificate and key from files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := r.load(r.lastModified()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// lastModified returns latest modification time of certificate and key files
+func (r *CertReloader) lastModified() time.Time {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime
+}
+
+func (r *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	r.modTime = modTime
+
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	modTime := r.lastModified()
+
+	r.mu.RLock()
+	cert, changed := r.cert, !modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+
+	if !changed {
+		return cert, nil
+	}
+
+	if err := r.load(modTime); err != nil {
+		// keep serving previous certificate until files are fixed
+		slog.Error("Reload TLS certificate", "cert", r.certFile, "key", r.keyFile, "err", err)
+
+		r.mu.Lock()
+		r.modTime = modTime
+		r.mu.Unlock()
+
+		return cert, nil
+	}
+
+	slog.Info("Reload TLS certificate", "cert", r.certFile, "key", r.keyFile)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// TLSConfig returns server config serving certificate of r
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// Transparent proxy modes
+const (
+	// TransparentRedirect recovers destination by SO_ORIGINAL_DST of iptables REDIRECT
+	TransparentRedirect = "redirect"
+	// TransparentTProxy uses local address of connection accepted by iptables TPROXY
+	TransparentTProxy = "tproxy"
+)
+
+var ErrNotRedirected = errors.New("connection is not redirected")
+
+// TransparentServer accepts TCP connections redirected by iptables and connects
+// them to original destination as socks5 CONNECT without authentication
+type TransparentServer struct {
+	Handler *Handler
+	Mode    string
+	// SniffTimeout enables hostname recovery from TLS SNI or HTTP Host,
+	// hostname is checked by rules with original destination IP, which is
+	// still dialed
+	SniffTimeout time.Duration
+
+	// originalDst overrides destination lookup of Mode
+	originalDst func(conn net.Conn) (*net.TCPAddr, error)
+}
+
+// ListenAndServe is used to create a listener and serve on it
+func (s *TransparentServer) ListenAndServe(network, addr string) error {
+	var lc net.ListenConfig
+	switch s.Mode {
+	case TransparentRedirect:
+	case TransparentTProxy:
+		lc.Control = transparentControl
+	default:
+		return fmt.Errorf("unknown transparent mode %q", s.Mode)
+	}
+
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve is used to serve connections from a listener
+func (s *TransparentServer) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.ServeConn(conn); err != nil {
+				slog.Error("Transparent", "remote", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+func (s *TransparentServer) destination(conn net.Conn) (*net.TCPAddr, error) {
+	if s.originalDst != nil {
+		return s.originalDst(conn)
+	}
+
+	if s.Mode == TransparentTProxy {
+		dest, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, ErrNotRedirected
+		}
+		return dest, nil
+	}
+
+	dest, err := originalDst(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SO_ORIGINAL_DST of direct connection is address of listener itself
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(dest.IP) && local.Port == dest.Port {
+		return nil, ErrNotRedirected
+	}
+
+	return dest, nil
+}
+
+// ServeConn is used to serve a single connection
+func (s *TransparentServer) ServeConn(conn net.Conn) error {
+	c := newPeekConn(conn)
+	defer c.Close()
+
+	dest, err := s.destination(conn)
+	if err != nil {
+		return err
+	}
+
+	spec := statute.AddrSpec{IP: dest.IP, Port: dest.Port, AddrType: statute.ATYPIPv4}
+	if dest.IP.To4() == nil {
+		spec.AddrType = statute.ATYPIPv6
+	}
+
+	request := NewRequest(statute.CommandConnect, spec, "", conn.LocalAddr(), conn.RemoteAddr())
+	// client chooses sniffed hostname, so it is not resolved and only
+	// narrows rules and connection table
+	if s.SniffTimeout > 0 {
+		if host := sniffHost(c, s.SniffTimeout); host != "" {
+			request.DestAddr = &statute.AddrSpec{FQDN: host, IP: dest.IP, Port: dest.Port, AddrType: statute.ATYPDomain}
+		}
+	}
+
+	ctx, err := s.Handler.Check(context.Background(), request)
+	if err != nil {
+		return fmt.Errorf("transparent: connect to %s: %w", dest, err)
+	}
+	target, err := s.Handler.dialRoute(ctx, request, nil)
+	if err != nil {
+		return fmt.Errorf("transparent: connect to %s: %w", dest, err)
+	}
+	defer target.Close()
+
+	slog.Debug("Transparent connect", "remote", conn.RemoteAddr(), "original", dest, "dest", request.DestAddr.Address())
+
+	return s.Handler.Tunnel(ctx, ProtocolTransparent, c, target, request)
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// originalDst returns destination of connection redirected by iptables REDIRECT
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("original destination: not TCP connection %T", conn)
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := false
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var dest *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv6 {
+			var info *unix.IPv6MTUInfo
+			info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+			if sockErr == nil {
+				// port is stored in network byte order
+				port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+				dest = &net.TCPAddr{
+					IP:   net.IP(info.Addr.Addr[:]).To16(),
+					Port: int(binary.BigEndian.Uint16(port)),
+				}
+			}
+			return
+		}
+
+		var mreq *unix.IPv6Mreq
+		mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if sockErr == nil {
+			// sockaddr_in: family, port, address
+			addr := mreq.Multiaddr
+			dest = &net.TCPAddr{
+				IP:   net.IPv4(addr[4], addr[5], addr[6], addr[7]),
+				Port: int(binary.BigEndian.Uint16(addr[2:4])),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("original destination: %w", sockErr)
+	}
+
+	return dest, nil
+}
+
+// transparentControl marks listener socket with IP_TRANSPARENT for TPROXY
+func transparentControl(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is supported only on linux")
+
+func originalDst(net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func transparentControl(string, string, syscall.RawConn) error {
+	return errTransparentUnsupported
+}
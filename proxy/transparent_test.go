@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"rgosocks/rules"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+)
+
+func startTransparentServer(t *testing.T, ruleSet socks5.RuleSet, dest *net.TCPAddr) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &TransparentServer{
+		Handler:      newHandler(nil, ruleSet),
+		Mode:         TransparentRedirect,
+		SniffTimeout: 200 * time.Millisecond,
+		originalDst:  func(net.Conn) (*net.TCPAddr, error) { return dest, nil },
+	}
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(func() { _ = l.Close() })
+
+	return l.Addr().String()
+}
+
+func transparentGet(t *testing.T, addr, host string) string {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET / HTTP/1.0\r\nHost: "+host+"\r\n\r\n")
+	require.NoError(t, err)
+
+	body, _ := io.ReadAll(conn)
+	return string(body)
+}
+
+func TestTransparent(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "transparent "+r.Host)
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	addr := startTransparentServer(t, socks5.NewPermitAll(), originAddr)
+	assert.Contains(t, transparentGet(t, addr, "localhost"), "transparent localhost")
+
+	// sniffed hostname does not change original destination
+	assert.Contains(t, transparentGet(t, addr, "other.invalid"), "transparent other.invalid")
+
+	// server first protocols wait for sniff timeout and connect by IP
+	greeter, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer greeter.Close()
+	go func() {
+		conn, err := greeter.Accept()
+		if err == nil {
+			_, _ = io.WriteString(conn, "220 ready\r\n")
+			_ = conn.Close()
+		}
+	}()
+
+	addr = startTransparentServer(t, socks5.NewPermitAll(), greeter.Addr().(*net.TCPAddr))
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	greeting, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "220 ready\r\n", string(greeting))
+}
+
+func TestTransparentRules(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "allowed")
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().(*net.TCPAddr)
+
+	addr := startTransparentServer(t, &rules.ProxyRulesSet{RejectFQDN: []string{"localhost"}}, originAddr)
+
+	// sniffed hostname is checked by FQDN rules
+	assert.Empty(t, transparentGet(t, addr, "localhost"))
+	assert.Contains(t, transparentGet(t, addr, "127.0.0.1"), "allowed")
+}
@@ -0,0 +1,426 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// udpBufferSize fits any UDP datagram
+const udpBufferSize = 64 * 1024
+
+// ProtocolSocks5UDP marks socks5 UDP associations in connection table
+const ProtocolSocks5UDP = "socks5-udp"
+
+var ErrUDPDisabled = errors.New("udp associate is disabled for user")
+
+// UDPRelay holds settings of socks5 UDP ASSOCIATE
+type UDPRelay struct {
+	// PortMin and PortMax limit relay ports, zero allows any port
+	PortMin int
+	PortMax int
+	// IdleTimeout closes association without datagrams, zero disables timeout
+	IdleTimeout time.Duration
+	// MaxTargets limits destination sockets of one association, least
+	// recently used socket is closed for new destination. Zero is no limit.
+	MaxTargets int
+	// AllowedUsers may use UDP, empty allows every user not in DeniedUsers
+	AllowedUsers []string
+	DeniedUsers  []string
+	Stats        *UDPStats
+}
+
+// UDPStats holds UDP relay counters exposed by status server.
+// All methods are safe to call on nil UDPStats.
+type UDPStats struct {
+	// Associations is the number of active associations
+	Associations atomic.Int64
+	// PacketsOut and BytesOut count datagrams sent from clients to destinations
+	PacketsOut atomic.Uint64
+	BytesOut   atomic.Uint64
+	// PacketsIn and BytesIn count datagrams sent from destinations to clients
+	PacketsIn atomic.Uint64
+	BytesIn   atomic.Uint64
+	// Dropped is the number of client datagrams rejected by rules or malformed
+	Dropped atomic.Uint64
+}
+
+type responseUDPStats struct {
+	Associations int64  `json:"associations"`
+	PacketsOut   uint64 `json:"packetsOut"`
+	BytesOut     uint64 `json:"bytesOut"`
+	PacketsIn    uint64 `json:"packetsIn"`
+	BytesIn      uint64 `json:"bytesIn"`
+	Dropped      uint64 `json:"dropped"`
+}
+
+func (s *UDPStats) associate(delta int64) {
+	if s != nil {
+		s.Associations.Add(delta)
+	}
+}
+
+func (s *UDPStats) out(n int) {
+	if s != nil {
+		s.PacketsOut.Add(1)
+		s.BytesOut.Add(uint64(n))
+	}
+}
+
+func (s *UDPStats) in(n int) {
+	if s != nil {
+		s.PacketsIn.Add(1)
+		s.BytesIn.Add(uint64(n))
+	}
+}
+
+func (s *UDPStats) drop() {
+	if s != nil {
+		s.Dropped.Add(1)
+	}
+}
+
+// Snapshot returns current counters for status response
+func (s *UDPStats) Snapshot() any {
+	if s == nil {
+		return responseUDPStats{}
+	}
+
+	return responseUDPStats{
+		Associations: s.Associations.Load(),
+		PacketsOut:   s.PacketsOut.Load(),
+		BytesOut:     s.BytesOut.Load(),
+		PacketsIn:    s.PacketsIn.Load(),
+		BytesIn:      s.BytesIn.Load(),
+		Dropped:      s.Dropped.Load(),
+	}
+}
+
+func (u *UDPRelay) userAllowed(user string) bool {
+	if slices.Contains(u.DeniedUsers, user) {
+		return false
+	}
+
+	return len(u.AllowedUsers) == 0 || slices.Contains(u.AllowedUsers, user)
+}
+
+// listen opens relay socket on ip with port from configured range
+func (u *UDPRelay) listen(ip net.IP) (*net.UDPConn, error) {
+	return listenPortRange(u.PortMin, u.PortMax, func(port int) (*net.UDPConn, error) {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	})
+}
+
+// udpAssociation relays datagrams of one client
+type udpAssociation struct {
+	handler *Handler
+	relay   *UDPRelay
+	req     *socks5.Request
+	bind    *net.UDPConn
+
+	mu sync.Mutex
+	// client is address of datagrams accepted from client, it is locked to
+	// the first datagram source when request does not define it
+	client *net.UDPAddr
+	// targets are sockets dialed to destinations by handler Dial
+	targets map[string]*udpTarget
+	closed  bool
+
+	lastActive atomic.Int64
+}
+
+// udpTarget is destination socket of association
+type udpTarget struct {
+	conn net.Conn
+	used time.Time
+}
+
+// Socks5Associate replaces UDP ASSOCIATE handler of socks5 server
+func (h *Handler) Socks5Associate(ctx context.Context, writer io.Writer, req *socks5.Request) error {
+	relay := h.UDP
+	if relay == nil {
+		relay = &UDPRelay{}
+	}
+
+	user := req.AuthContext.Payload["username"]
+	if !relay.userAllowed(user) {
+		_ = socks5.SendReply(writer, statute.RepRuleFailure, nil)
+		return fmt.Errorf("socks5: %w: %q", ErrUDPDisabled, user)
+	}
+
+	// relay socket is bound to address of this host, not to address of
+	// PROXY protocol header
+	localAddr := req.LocalAddr
+	if conn, ok := writer.(net.Conn); ok {
+		localAddr = socketLocalAddr(conn)
+	}
+	local, ok := localAddr.(*net.TCPAddr)
+	if !ok {
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return fmt.Errorf("socks5: local address is not TCP: %T", localAddr)
+	}
+
+	bind, err := relay.listen(local.IP)
+	if err != nil {
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return fmt.Errorf("socks5: udp associate: %w", err)
+	}
+
+	a := &udpAssociation{
+		handler: h,
+		relay:   relay,
+		req:     req,
+		bind:    bind,
+		targets: make(map[string]*udpTarget),
+	}
+	defer a.Close()
+
+	// client may declare its source address, zero address means unknown
+	if remote, ok := req.RemoteAddr.(*net.TCPAddr); ok && req.RawDestAddr.Port != 0 {
+		ip := req.RawDestAddr.IP
+		if ip == nil || ip.IsUnspecified() {
+			ip = remote.IP
+		}
+		a.client = &net.UDPAddr{IP: ip, Port: req.RawDestAddr.Port}
+	}
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, bind.LocalAddr()); err != nil {
+		return fmt.Errorf("socks5: send reply: %w", err)
+	}
+
+	relay.Stats.associate(1)
+	defer relay.Stats.associate(-1)
+
+	// association is listed with relay address as destination, closing it
+	// by connection table ends its TCP connection too
+	id := h.Conns.Add(ConnInfo{
+		Protocol: ProtocolSocks5UDP,
+		User:     user,
+		Client:   req.RemoteAddr.String(),
+		Dest:     bind.LocalAddr().String(),
+		Started:  time.Now(),
+	}, a)
+	defer h.Conns.Remove(id)
+
+	slog.Debug("UDP associate", "remote", req.RemoteAddr, "user", user, "bind", bind.LocalAddr())
+
+	// association ends with its TCP connection
+	go func() {
+		_, _ = io.Copy(io.Discard, req.Reader)
+		_ = a.Close()
+	}()
+
+	return a.serve(ctx)
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActive.Store(time.Now().UnixNano())
+}
+
+func (a *udpAssociation) idle() bool {
+	timeout := a.relay.IdleTimeout
+	return timeout > 0 && time.Since(time.Unix(0, a.lastActive.Load())) >= timeout
+}
+
+// Close stops relay socket and destination sockets of association
+func (a *udpAssociation) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+
+	_ = a.bind.Close()
+	for _, target := range a.targets {
+		_ = target.conn.Close()
+	}
+
+	return nil
+}
+
+// acceptSource checks that datagram comes from client of association
+func (a *udpAssociation) acceptSource(src *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.client == nil {
+		remote, ok := a.req.RemoteAddr.(*net.TCPAddr)
+		if !ok || !remote.IP.Equal(src.IP) {
+			return false
+		}
+		a.client = src
+	}
+
+	return a.client.IP.Equal(src.IP) && a.client.Port == src.Port
+}
+
+// serve reads client datagrams until association is closed or idle
+func (a *udpAssociation) serve(ctx context.Context) error {
+	a.touch()
+	buf := make([]byte, udpBufferSize)
+
+	for {
+		if a.relay.IdleTimeout > 0 {
+			_ = a.bind.SetReadDeadline(time.Now().Add(a.relay.IdleTimeout))
+		}
+
+		n, src, err := a.bind.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if a.idle() {
+					slog.Debug("UDP associate idle", "remote", a.req.RemoteAddr)
+					return nil
+				}
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("socks5: udp read: %w", err)
+		}
+
+		if !a.acceptSource(src) {
+			a.relay.Stats.drop()
+			continue
+		}
+
+		if err := a.forward(ctx, buf[:n]); err != nil {
+			a.relay.Stats.drop()
+			slog.Debug("UDP datagram dropped", "remote", a.req.RemoteAddr, "err", err)
+		}
+	}
+}
+
+// forward checks destination of client datagram by rules and sends its data
+func (a *udpAssociation) forward(ctx context.Context, packet []byte) error {
+	datagram, err := statute.ParseDatagram(packet)
+	if err != nil {
+		return err
+	}
+	// fragmentation is not supported, fragments are dropped as RFC 1928 allows
+	if datagram.Frag != 0 {
+		return fmt.Errorf("fragment %d", datagram.Frag)
+	}
+
+	dest := datagram.DstAddr
+	if dest.FQDN != "" {
+		if _, dest.IP, err = a.handler.Resolver.Resolve(ctx, dest.FQDN); err != nil {
+			return fmt.Errorf("%w: resolve %s: %v", ErrHostUnreachable, dest.FQDN, err)
+		}
+	}
+
+	req := *a.req
+	req.DestAddr = &dest
+	if _, err := a.handler.Check(ctx, &req); err != nil {
+		return err
+	}
+
+	target, err := a.target(ctx, dest)
+	if err != nil {
+		return err
+	}
+
+	if _, err := target.Write(datagram.Data); err != nil {
+		return err
+	}
+
+	a.touch()
+	a.relay.Stats.out(len(datagram.Data))
+
+	return nil
+}
+
+// target returns socket connected to dest, replies of new socket are relayed to client
+func (a *udpAssociation) target(ctx context.Context, dest statute.AddrSpec) (net.Conn, error) {
+	key := dest.String()
+
+	a.mu.Lock()
+	if target, ok := a.targets[key]; ok {
+		target.used = time.Now()
+		a.mu.Unlock()
+		return target.conn, nil
+	}
+	a.mu.Unlock()
+
+	target, err := a.handler.Dial(ctx, "udp", key)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		_ = target.Close()
+		return nil, net.ErrClosed
+	}
+	if a.relay.MaxTargets > 0 && len(a.targets) >= a.relay.MaxTargets {
+		a.evictTarget()
+	}
+	a.targets[key] = &udpTarget{conn: target, used: time.Now()}
+	a.mu.Unlock()
+
+	go a.relayReplies(target, dest)
+
+	return target, nil
+}
+
+// evictTarget closes least recently used destination socket, its replies
+// are not relayed anymore. Caller holds a.mu.
+func (a *udpAssociation) evictTarget() {
+	var lru string
+	for key, target := range a.targets {
+		if lru == "" || target.used.Before(a.targets[lru].used) {
+			lru = key
+		}
+	}
+
+	slog.Debug("UDP target evicted", "remote", a.req.RemoteAddr, "dest", lru)
+	_ = a.targets[lru].conn.Close()
+	delete(a.targets, lru)
+}
+
+// relayReplies sends datagrams of destination to client with socks5 header
+func (a *udpAssociation) relayReplies(target net.Conn, dest statute.AddrSpec) {
+	// replies carry destination as client sent it, so hostnames are kept
+	header := statute.Datagram{DstAddr: dest}
+	if dest.FQDN != "" {
+		header.DstAddr = statute.AddrSpec{FQDN: dest.FQDN, Port: dest.Port, AddrType: statute.ATYPDomain}
+	} else if dest.IP.To4() != nil {
+		header.DstAddr.AddrType = statute.ATYPIPv4
+	} else {
+		header.DstAddr.AddrType = statute.ATYPIPv6
+	}
+	prefix := header.Header()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+
+		if _, err := a.bind.WriteToUDP(append(prefix[:len(prefix):len(prefix)], buf[:n]...), client); err != nil {
+			return
+		}
+
+		a.touch()
+		a.relay.Stats.in(n)
+	}
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"rgosocks/rules"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+func startUDPEcho(t *testing.T, ip net.IP) *net.UDPAddr {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echo.Close() })
+
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	return echo.LocalAddr().(*net.UDPAddr)
+}
+
+// socks5Associate authenticates as user and requests UDP ASSOCIATE, returns reply code and relay address
+func socks5Associate(t *testing.T, addr, user string) (net.Conn, byte, *net.UDPAddr) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	require.Equal(t, byte(0), socks5Handshake(t, conn, user, "pass"))
+
+	_, err = conn.Write([]byte{5, statute.CommandAssociate, 0, 1, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+
+	relay := &net.UDPAddr{
+		IP:   net.IPv4(reply[4], reply[5], reply[6], reply[7]),
+		Port: int(binary.BigEndian.Uint16(reply[8:])),
+	}
+
+	return conn, reply[1], relay
+}
+
+func udpExchange(t *testing.T, client *net.UDPConn, relay, dest *net.UDPAddr, data string) (string, error) {
+	datagram, err := statute.NewDatagram(dest.String(), []byte(data))
+	require.NoError(t, err)
+	_, err = client.WriteToUDP(datagram.Bytes(), relay)
+	require.NoError(t, err)
+
+	_ = client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, udpBufferSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := statute.ParseDatagram(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, dest.String(), reply.DstAddr.String())
+
+	return string(reply.Data), nil
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := startUDPEcho(t, net.IPv4(127, 0, 0, 1))
+	blocked := startUDPEcho(t, net.IPv4(127, 0, 0, 2))
+
+	credentials := socks5.StaticCredentials{"user": "pass", "nudp": "pass"}
+	ruleSet := &rules.ProxyRulesSet{RejectIPNet: []*net.IPNet{{IP: blocked.IP, Mask: net.CIDRMask(32, 32)}}}
+	handler := newHandler(credentials, ruleSet)
+	handler.Conns = NewConnTable()
+	handler.UDP = &UDPRelay{
+		PortMin:     41000,
+		PortMax:     41100,
+		IdleTimeout: 500 * time.Millisecond,
+		DeniedUsers: []string{"nudp"},
+		Stats:       new(UDPStats),
+	}
+	addr := startServer(t, &Server{
+		Handler: handler,
+		Socks5: socks5.NewServer(
+			socks5.WithCredential(credentials),
+			socks5.WithAssociateHandle(handler.Socks5Associate),
+		),
+	})
+
+	conn, status, relay := socks5Associate(t, addr, "user")
+	require.Equal(t, statute.RepSuccess, status)
+	assert.True(t, relay.Port >= 41000 && relay.Port <= 41100, relay.Port)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer client.Close()
+
+	reply, err := udpExchange(t, client, relay, echo, "ping")
+	require.NoError(t, err)
+	assert.Equal(t, "ping", reply)
+
+	_, err = udpExchange(t, client, relay, blocked, "blocked")
+	assert.Error(t, err)
+
+	stats := handler.UDP.Stats.Snapshot().(responseUDPStats)
+	assert.Equal(t, responseUDPStats{
+		Associations: 1,
+		PacketsOut:   1,
+		BytesOut:     4,
+		PacketsIn:    1,
+		BytesIn:      4,
+		Dropped:      1,
+	}, stats)
+
+	// idle association is closed with its TCP connection
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return handler.UDP.Stats.Associations.Load() == 0 }, time.Second, 10*time.Millisecond)
+
+	// user without UDP
+	_, status, _ = socks5Associate(t, addr, "nudp")
+	assert.Equal(t, statute.RepRuleFailure, status)
+
+	// association is closed by connection table with its TCP connection
+	conn, status, relay = socks5Associate(t, addr, "user")
+	require.Equal(t, statute.RepSuccess, status)
+	require.Eventually(t, func() bool { return len(handler.Conns.List()) == 1 }, time.Second, 10*time.Millisecond)
+	info := handler.Conns.List()[0]
+	assert.Equal(t, ProtocolSocks5UDP, info.Protocol)
+	assert.Equal(t, "user", info.User)
+	assert.Equal(t, relay.String(), info.Dest)
+
+	assert.Equal(t, 1, handler.Conns.Close(func(info ConnInfo) bool { return info.User == "user" }))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool { return len(handler.Conns.List()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+// startUDPSourceEcho replies with source address of every datagram
+func startUDPSourceEcho(t *testing.T) *net.UDPAddr {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = echo.Close() })
+
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			_, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP([]byte(addr.String()), addr)
+		}
+	}()
+
+	return echo.LocalAddr().(*net.UDPAddr)
+}
+
+func TestUDPMaxTargets(t *testing.T) {
+	first := startUDPSourceEcho(t)
+	second := startUDPSourceEcho(t)
+
+	credentials := socks5.StaticCredentials{"user": "pass"}
+	handler := newHandler(credentials, &rules.ProxyRulesSet{})
+	handler.UDP = &UDPRelay{MaxTargets: 1}
+	addr := startServer(t, &Server{
+		Handler: handler,
+		Socks5: socks5.NewServer(
+			socks5.WithCredential(credentials),
+			socks5.WithAssociateHandle(handler.Socks5Associate),
+		),
+	})
+
+	_, status, relay := socks5Associate(t, addr, "user")
+	require.Equal(t, statute.RepSuccess, status)
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer client.Close()
+
+	source, err := udpExchange(t, client, relay, first, "ping")
+	require.NoError(t, err)
+	reused, err := udpExchange(t, client, relay, first, "ping")
+	require.NoError(t, err)
+	assert.Equal(t, source, reused)
+
+	// new destination closes socket of least recently used one
+	_, err = udpExchange(t, client, relay, second, "ping")
+	require.NoError(t, err)
+	redialed, err := udpExchange(t, client, relay, first, "ping")
+	require.NoError(t, err)
+	assert.NotEqual(t, source, redialed)
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users is credential store of usernames and passwords, password
+// starting with "$2" is checked as bcrypt hash
+type Users map[string]string
+
+// LoadUsers reads credential file of "user:password" lines, passwords are
+// plain or bcrypt hashes made by hash-password command. Empty lines and
+// lines starting with # are skipped.
+func LoadUsers(path string) (Users, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(Users)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		user, password, ok := strings.Cut(text, ":")
+		if !ok || user == "" || password == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, line)
+		}
+		users[user] = password
+	}
+
+	return users, scanner.Err()
+}
+
+// HashPassword returns bcrypt hash of password for credential file
+func HashPassword(password string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(hash), err
+}
+
+// Valid implements socks5.CredentialStore
+func (u Users) Valid(user, password, _ string) bool {
+	stored, ok := u[user]
+	if !ok {
+		return false
+	}
+
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUsers(t *testing.T) {
+	hash, err := HashPassword("hashed-pass", bcrypt.MinCost)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "users")
+	require.NoError(t, os.WriteFile(path, []byte("# proxy users\n\nalice:"+hash+"\nbob:plain-pass\n"), 0o600))
+
+	users, err := LoadUsers(path)
+	require.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	assert.True(t, users.Valid("alice", "hashed-pass", ""))
+	assert.False(t, users.Valid("alice", hash, ""))
+	assert.True(t, users.Valid("bob", "plain-pass", ""))
+	assert.False(t, users.Valid("bob", "wrong", ""))
+	assert.False(t, users.Valid("carol", "plain-pass", ""))
+
+	require.NoError(t, os.WriteFile(path, []byte("alice:"+hash+"\nbob\n"), 0o600))
+	_, err = LoadUsers(path)
+	assert.ErrorContains(t, err, "users:2: expected user:password")
+}
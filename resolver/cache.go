@@ -0,0 +1,150 @@
+package resolver
+
+import (
+	"cmp"
+	"log/slog"
+	"net"
+	"rgosocks/config"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// prefetchMinHits is how many cache hits a name needs before it is
+	// refreshed in background ahead of expiry
+	prefetchMinHits = 3
+	// prefetchWindow is the fraction of the original TTL left when prefetch starts
+	prefetchWindow = 10
+	// evictDivisor controls how many of the least recently used entries are
+	// dropped at once when the cache is full (1/evictDivisor of max entries)
+	evictDivisor = 16
+)
+
+// cacheEntry is the value stored in DNSResolver.Cache.
+// Entry with empty IPs is a negative answer (NXDOMAIN/NODATA).
+type cacheEntry struct {
+	IPs []net.IP
+	// TTL the entry was stored with, after clamping
+	TTL time.Duration
+	// Expires is the end of the fresh period. The item lives in the cache
+	// up to DNS_CACHE_STALE_TTL longer to be served when upstream fails.
+	Expires time.Time
+
+	hits       atomic.Uint64
+	lastUsed   atomic.Int64
+	refreshing atomic.Bool
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *cacheEntry) touch(now time.Time) {
+	e.hits.Add(1)
+	e.lastUsed.Store(now.UnixNano())
+}
+
+// needPrefetch reports whether a popular entry is close to expiry and nobody
+// is refreshing it yet
+func (e *cacheEntry) needPrefetch(now time.Time) bool {
+	if !config.Cfg.DnsCachePrefetch || len(e.IPs) == 0 || e.hits.Load() < prefetchMinHits {
+		return false
+	}
+
+	if e.Expires.Sub(now) > e.TTL/prefetchWindow {
+		return false
+	}
+
+	return e.refreshing.CompareAndSwap(false, true)
+}
+
+// clampTtl applies DNS_CACHE_MIN_TTL and DNS_CACHE_MAX_TTL to answer ttl
+func clampTtl(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+
+	if config.Cfg.DnsCacheMinTtl > 0 && d < config.Cfg.DnsCacheMinTtl {
+		d = config.Cfg.DnsCacheMinTtl
+	}
+
+	if config.Cfg.DnsCacheMaxTtl > 0 && d > config.Cfg.DnsCacheMaxTtl {
+		d = config.Cfg.DnsCacheMaxTtl
+	}
+
+	return d
+}
+
+func (d DNSResolver) cacheEnabled() bool {
+	return config.Cfg.DnsUseCache && d.Cache != nil
+}
+
+func (d DNSResolver) cacheGet(name string) (*cacheEntry, bool) {
+	val, found := d.Cache.Get(name)
+	if !found {
+		return nil, false
+	}
+
+	entry, ok := val.(*cacheEntry)
+	return entry, ok
+}
+
+// cacheSet stores answer for name. Negative answers are stored only when
+// DNS_CACHE_NEGATIVE is enabled and upstream provided SOA ttl (RFC 2308).
+func (d DNSResolver) cacheSet(name string, ips []net.IP, ttl uint32) {
+	if len(ips) == 0 && (!config.Cfg.DnsCacheNegative || ttl == 0) {
+		return
+	}
+
+	expiration := clampTtl(ttl)
+	if expiration <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		IPs:     ips,
+		TTL:     expiration,
+		Expires: now.Add(expiration),
+	}
+	entry.lastUsed.Store(now.UnixNano())
+
+	if _, found := d.Cache.Get(name); !found {
+		d.evict()
+	}
+
+	d.Cache.Set(name, entry, entry.TTL+config.Cfg.DnsCacheStaleTtl)
+}
+
+// evict drops least recently used entries when cache reached DNS_CACHE_MAX_ENTRIES
+func (d DNSResolver) evict() {
+	limit := config.Cfg.DnsCacheMaxEntries
+	if limit <= 0 || d.Cache.ItemCount() < limit {
+		return
+	}
+
+	type usage struct {
+		name     string
+		lastUsed int64
+	}
+
+	items := d.Cache.Items()
+	list := make([]usage, 0, len(items))
+	for name, item := range items {
+		var lastUsed int64
+		if entry, ok := item.Object.(*cacheEntry); ok {
+			lastUsed = entry.lastUsed.Load()
+		}
+		list = append(list, usage{name, lastUsed})
+	}
+
+	slices.SortFunc(list, func(a, b usage) int {
+		return cmp.Compare(a.lastUsed, b.lastUsed)
+	})
+
+	cnt := len(list) - limit + max(1, limit/evictDivisor)
+	for _, item := range list[:min(cnt, len(list))] {
+		d.Cache.Delete(item.name)
+	}
+
+	slog.Debug("Resolve cache evict", "count", cnt)
+}
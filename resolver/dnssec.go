@@ -0,0 +1,524 @@
+package resolver
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"os"
+	"rgosocks/config"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSEC modes of DNS_DNSSEC
+const (
+	// DnssecOff trusts any answer of DNS server
+	DnssecOff = "off"
+	// DnssecAD requires AD flag from trusted validating DNS server
+	DnssecAD = "ad"
+	// DnssecValidate validates signatures of answers from DNS_DNSSEC_TRUST_ANCHOR
+	DnssecValidate = "validate"
+)
+
+var ErrDnssecBogus = errors.New("dnssec: validation failed")
+
+// TrustAnchor holds DS and DNSKEY records trusted without validation and
+// caches DNSKEY sets of zones validated through the chain of trust.
+type TrustAnchor struct {
+	ds   map[string][]*dns.DS
+	keys map[string][]*dns.DNSKEY
+
+	mu        sync.Mutex
+	validated map[string]validatedKeys
+}
+
+type validatedKeys struct {
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// LoadTrustAnchor reads trust anchor from file in zone file format
+func LoadTrustAnchor(path string) (*TrustAnchor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseTrustAnchor(f, path)
+}
+
+// ParseTrustAnchor parses DS and DNSKEY records in zone file format, e.g.
+//
+//	. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+func ParseTrustAnchor(r io.Reader, file string) (*TrustAnchor, error) {
+	anchor := &TrustAnchor{
+		ds:        make(map[string][]*dns.DS),
+		keys:      make(map[string][]*dns.DNSKEY),
+		validated: make(map[string]validatedKeys),
+	}
+
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		zone := dns.CanonicalName(rr.Header().Name)
+		switch rec := rr.(type) {
+		case *dns.DS:
+			anchor.ds[zone] = append(anchor.ds[zone], rec)
+		case *dns.DNSKEY:
+			anchor.keys[zone] = append(anchor.keys[zone], rec)
+		default:
+			return nil, fmt.Errorf("%s: unexpected %s record in trust anchor", file, dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(anchor.ds) == 0 && len(anchor.keys) == 0 {
+		return nil, fmt.Errorf("%s: no DS or DNSKEY records", file)
+	}
+
+	return anchor, nil
+}
+
+func (a *TrustAnchor) cached(zone string) []*dns.DNSKEY {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if v, ok := a.validated[zone]; ok && time.Now().Before(v.expires) {
+		return v.keys
+	}
+
+	return nil
+}
+
+func (a *TrustAnchor) store(zone string, keys []*dns.DNSKEY, ttl uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.validated[zone] = validatedKeys{keys, time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// newQuery prepares query message with DNSSEC OK bit when DNS_DNSSEC is enabled
+func newQuery(name string, t uint16) *dns.Msg {
+	m := new(dns.Msg)
+
+	m.SetQuestion(dns.Fqdn(name), t)
+	m.RecursionDesired = true
+
+	switch config.Cfg.DnsDnssec {
+	case DnssecAD:
+		m.AuthenticatedData = true
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	case DnssecValidate:
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	return m
+}
+
+// maxChain limits CNAME chain followed in answer
+const maxChain = 8
+
+// answerChain returns CNAME and type t records of answer owned by name or by
+// targets of its CNAME chain with their signatures, and the last owner of
+// chain. Records of other owners are not part of answer to query.
+func answerChain(name string, t uint16, answer []dns.RR) ([]dns.RR, string) {
+	owner := dns.CanonicalName(name)
+	owners := map[string]bool{owner: true}
+	for range maxChain {
+		next := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == owner {
+				next = dns.CanonicalName(cname.Target)
+				break
+			}
+		}
+		if next == "" || owners[next] {
+			break
+		}
+		owner = next
+		owners[owner] = true
+	}
+
+	var chain []dns.RR
+	for _, rr := range answer {
+		rtype := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rtype = sig.TypeCovered
+		}
+		if (rtype == t || rtype == dns.TypeCNAME) && owners[dns.CanonicalName(rr.Header().Name)] {
+			chain = append(chain, rr)
+		}
+	}
+
+	return chain, owner
+}
+
+// checkDnssec verifies answer according to DNS_DNSSEC, name is the last owner
+// of chain and positive reports whether chain has addresses
+func (d DNSResolver) checkDnssec(ctx context.Context, name string, t uint16, r *dns.Msg, chain []dns.RR, positive bool) error {
+	switch config.Cfg.DnsDnssec {
+	case DnssecAD:
+		if !r.AuthenticatedData {
+			return fmt.Errorf("%w: %s: answer is not authenticated", ErrDnssecBogus, name)
+		}
+	case DnssecValidate:
+		if err := d.verifyAnswer(ctx, chain, r.Ns); err != nil {
+			return err
+		}
+		if !positive {
+			return d.verifyDenial(ctx, name, t, r)
+		}
+	}
+
+	return nil
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// groupRRsets splits records to RRsets and signatures covering them
+func groupRRsets(records []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+	sets := make(map[rrsetKey][]dns.RR)
+	sigs := make(map[rrsetKey][]*dns.RRSIG)
+
+	for _, rr := range records {
+		name := dns.CanonicalName(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name, sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+
+		key := rrsetKey{name, rr.Header().Rrtype}
+		sets[key] = append(sets[key], rr)
+	}
+
+	return sets, sigs
+}
+
+// verifyAnswer validates every RRset of answer chain. RRset expanded from
+// wildcard needs NSEC or NSEC3 of authority proving that its name does not exist.
+func (d DNSResolver) verifyAnswer(ctx context.Context, answer, authority []dns.RR) error {
+	sets, sigs := groupRRsets(answer)
+	for key, set := range sets {
+		sig, err := d.verifyRRset(ctx, set, sigs[key])
+		if err != nil {
+			return err
+		}
+
+		labels := dns.CountLabel(key.name)
+		if strings.HasPrefix(key.name, "*.") {
+			labels--
+		}
+		if int(sig.Labels) < labels {
+			if err := d.verifyWildcard(ctx, key.name, sig, authority); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifyRRset checks that rrset is signed by validated key of signer zone
+// and returns matching signature
+func (d DNSResolver) verifyRRset(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG) (*dns.RRSIG, error) {
+	name := rrset[0].Header().Name
+	err := errors.New("no signature")
+
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(time.Now()) {
+			err = errors.New("signature expired")
+			continue
+		}
+
+		if !dns.IsSubDomain(sig.SignerName, name) {
+			err = fmt.Errorf("signer %s is not parent of name", sig.SignerName)
+			continue
+		}
+
+		var keys []*dns.DNSKEY
+		keys, err = d.zoneKeys(ctx, dns.CanonicalName(sig.SignerName))
+		if err != nil {
+			continue
+		}
+
+		if verifySig(sig, keys, rrset) {
+			return sig, nil
+		}
+		err = errors.New("signature does not match")
+	}
+
+	return nil, fmt.Errorf("%w: %s %s: %v", ErrDnssecBogus, name, dns.TypeToString[rrset[0].Header().Rrtype], err)
+}
+
+// proofRecords validates SOA, NSEC and NSEC3 RRsets of authority section and
+// returns NSEC and NSEC3 records
+func (d DNSResolver) proofRecords(ctx context.Context, authority []dns.RR) ([]*dns.NSEC, []*dns.NSEC3, error) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+
+	sets, sigs := groupRRsets(authority)
+	for key, set := range sets {
+		switch key.rtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+
+		if _, err := d.verifyRRset(ctx, set, sigs[key]); err != nil {
+			return nil, nil, err
+		}
+
+		for _, rr := range set {
+			switch rec := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rec)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rec)
+			}
+		}
+	}
+
+	return nsecs, nsec3s, nil
+}
+
+// verifyWildcard checks that name of RRset expanded from wildcard by sig does
+// not exist, NSEC3 proof covers the next closer name
+func (d DNSResolver) verifyWildcard(ctx context.Context, name string, sig *dns.RRSIG, authority []dns.RR) error {
+	nsecs, nsec3s, err := d.proofRecords(ctx, authority)
+	if err != nil {
+		return err
+	}
+
+	labels := dns.SplitDomainName(name)
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+	if slices.ContainsFunc(nsecs, func(nsec *dns.NSEC) bool { return nsecCovers(nsec, name) }) ||
+		slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Cover(nextCloser) }) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s: wildcard answer without proof of nonexistence", ErrDnssecBogus, name)
+}
+
+// verifyDenial checks NSEC or NSEC3 proof of NXDOMAIN or NODATA answer for name
+func (d DNSResolver) verifyDenial(ctx context.Context, name string, t uint16, r *dns.Msg) error {
+	nsecs, nsec3s, err := d.proofRecords(ctx, r.Ns)
+	if err != nil {
+		return err
+	}
+
+	var proved bool
+	if r.Rcode == dns.RcodeNameError {
+		proved = nsecDeniesName(name, nsecs) || nsec3DeniesName(name, nsec3s)
+	} else {
+		proved = slices.ContainsFunc(nsecs, func(nsec *dns.NSEC) bool {
+			return dns.CanonicalName(nsec.Hdr.Name) == name && deniesType(nsec.TypeBitMap, t)
+		}) || slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool {
+			return nsec3.Match(name) && deniesType(nsec3.TypeBitMap, t)
+		})
+	}
+	if !proved {
+		return fmt.Errorf("%w: %s %s: negative answer without proof", ErrDnssecBogus, name, dns.TypeToString[t])
+	}
+
+	return nil
+}
+
+// deniesType reports whether type bitmap has neither t nor CNAME
+func deniesType(bitmap []uint16, t uint16) bool {
+	return !slices.Contains(bitmap, t) && !slices.Contains(bitmap, dns.TypeCNAME)
+}
+
+// nsecDeniesName checks that NSEC records cover name and wildcard of its
+// closest encloser
+func nsecDeniesName(name string, nsecs []*dns.NSEC) bool {
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+
+		labels := dns.SplitDomainName(name)
+		common := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+		wildcard := dns.Fqdn(strings.Join(append([]string{"*"}, labels[len(labels)-common:]...), "."))
+
+		return slices.ContainsFunc(nsecs, func(nsec *dns.NSEC) bool { return nsecCovers(nsec, wildcard) })
+	}
+
+	return false
+}
+
+// nsec3DeniesName checks closest encloser proof of RFC 5155: NSEC3 matching
+// closest encloser and NSEC3 covering next closer name and wildcard
+func nsec3DeniesName(name string, nsec3s []*dns.NSEC3) bool {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Match(encloser) }) {
+			continue
+		}
+
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		wildcard := dns.Fqdn("*." + strings.Join(labels[i:], "."))
+		return slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Cover(nextCloser) }) &&
+			slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Cover(wildcard) })
+	}
+
+	return false
+}
+
+// nsecCovers reports whether name is between owner and next name of NSEC in
+// canonical order, last NSEC of zone covers names after its owner
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := canonicalCompare(nsec.Hdr.Name, name)
+	next := canonicalCompare(name, nsec.NextDomain)
+	if canonicalCompare(nsec.Hdr.Name, nsec.NextDomain) < 0 {
+		return owner < 0 && next < 0
+	}
+
+	return owner < 0 || next < 0
+}
+
+// canonicalCompare compares names in canonical DNS order of RFC 4034 by
+// labels from the rightmost one
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(len(la), len(lb))
+}
+
+func verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) bool {
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// zoneKeys returns DNSKEY set of zone validated by trust anchor directly or
+// by DS records of parent zone
+func (d DNSResolver) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	if d.TrustAnchor == nil {
+		return nil, errors.New("no trust anchor")
+	}
+
+	if keys := d.TrustAnchor.keys[zone]; len(keys) > 0 {
+		return keys, nil
+	}
+
+	if keys := d.TrustAnchor.cached(zone); keys != nil {
+		return keys, nil
+	}
+
+	ds := d.TrustAnchor.ds[zone]
+	if len(ds) == 0 {
+		if zone == "." {
+			return nil, errors.New("no trust anchor for root zone")
+		}
+
+		dsSet, dsSigs, err := d.queryRRset(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		if len(dsSet) == 0 {
+			return nil, fmt.Errorf("no DS records for %s", zone)
+		}
+		if _, err := d.verifyRRset(ctx, dsSet, dsSigs); err != nil {
+			return nil, err
+		}
+
+		for _, rr := range dsSet {
+			ds = append(ds, rr.(*dns.DS))
+		}
+	}
+
+	keySet, keySigs, err := d.queryRRset(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys, secure []*dns.DNSKEY
+	ttl := uint32(0)
+	for _, rr := range keySet {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		if ttl == 0 || key.Hdr.Ttl < ttl {
+			ttl = key.Hdr.Ttl
+		}
+
+		for _, rec := range ds {
+			if digest := key.ToDS(rec.DigestType); digest != nil && digest.KeyTag == rec.KeyTag &&
+				strings.EqualFold(digest.Digest, rec.Digest) {
+				secure = append(secure, key)
+			}
+		}
+	}
+
+	if len(secure) == 0 {
+		return nil, fmt.Errorf("no DNSKEY of %s matches DS", zone)
+	}
+
+	valid := false
+	for _, sig := range keySigs {
+		if sig.ValidityPeriod(time.Now()) && verifySig(sig, secure, keySet) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("DNSKEY set of %s is not signed by key matching DS", zone)
+	}
+
+	d.TrustAnchor.store(zone, keys, ttl)
+
+	return keys, nil
+}
+
+// queryRRset queries records of type t with their signatures
+func (d DNSResolver) queryRRset(ctx context.Context, name string, t uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, t)
+	m.RecursionDesired = true
+	m.SetEdns0(dns.DefaultMsgSize, true)
+
+	r, err := d.exchangeMsg(ctx, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, nil, fmt.Errorf("dns: %s for %s %s", dns.RcodeToString[r.Rcode], name, dns.TypeToString[t])
+	}
+
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range r.Answer {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == t {
+			set = append(set, rr)
+		}
+	}
+
+	return set, sigs, nil
+}
@@ -0,0 +1,240 @@
+package resolver
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"rgosocks/config"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedZone is a local DNS server with zone example. and its signed
+// delegation sub.example.
+type signedZone struct {
+	records map[rrsetKey][]dns.RR
+	// authority and nxdomain are authority section and NXDOMAIN code of answers by name
+	authority map[string][]dns.RR
+	nxdomain  map[string]bool
+	parent    *dns.DNSKEY
+	address   string
+}
+
+func newZoneKey(t *testing.T, zone string) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+
+	return key, priv.(crypto.Signer)
+}
+
+func (z *signedZone) add(t *testing.T, key *dns.DNSKEY, signer crypto.Signer, rrset ...dns.RR) {
+	hdr := rrset[0].Header()
+	k := rrsetKey{hdr.Name, hdr.Rrtype}
+	if signer == nil {
+		z.records[k] = append(z.records[k], rrset...)
+		return
+	}
+	z.records[k] = append(z.records[k], sign(t, key, signer, rrset...)...)
+}
+
+// sign returns rrset with its signature
+func sign(t *testing.T, key *dns.DNSKEY, signer crypto.Signer, rrset ...dns.RR) []dns.RR {
+	hdr := rrset[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+		Algorithm:  key.Algorithm,
+	}
+	require.NoError(t, sig.Sign(signer, rrset))
+
+	return append(rrset, sig)
+}
+
+func newNSEC(name, next string, types ...uint16) *dns.NSEC {
+	types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	slices.Sort(types)
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 60},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+func newA(name, ip string) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	}
+}
+
+func startSignedZone(t *testing.T) *signedZone {
+	z := &signedZone{
+		records:   make(map[rrsetKey][]dns.RR),
+		authority: make(map[string][]dns.RR),
+		nxdomain:  make(map[string]bool),
+	}
+
+	key, signer := newZoneKey(t, "example.")
+	z.parent = key
+	z.add(t, key, signer, key)
+	z.add(t, key, signer, newA("secure.example.", ipv4))
+	z.add(t, key, nil, newA("unsigned.example.", ipv4))
+
+	bogus := newA("bogus.example.", ipv4)
+	z.add(t, key, signer, bogus)
+	bogus.A = net.ParseIP("10.0.0.1")
+
+	// signed record of other owner
+	z.records[rrsetKey{"bank.example.", dns.TypeA}] = z.records[rrsetKey{"secure.example.", dns.TypeA}]
+
+	// signed CNAME chain
+	z.records[rrsetKey{"alias.example.", dns.TypeA}] = append(sign(t, key, signer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "alias.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "secure.example.",
+	}), z.records[rrsetKey{"secure.example.", dns.TypeA}]...)
+
+	// negative answers with and without proof
+	z.nxdomain["forged.example."] = true
+	z.nxdomain["missing.example."] = true
+	z.authority["missing.example."] = append(sign(t, key, signer, newNSEC("bogus.example.", "secure.example.", dns.TypeA)),
+		sign(t, key, signer, newNSEC("example.", "bogus.example.", dns.TypeDNSKEY))...)
+	z.records[rrsetKey{"nodata.example.", dns.TypeA}] = nil
+	z.authority["nodata.example."] = sign(t, key, signer, newNSEC("nodata.example.", "secure.example.", dns.TypeTXT))
+
+	// answers expanded from wildcard with and without proof
+	for _, name := range []string{"x.wild.example.", "y.wild.example."} {
+		wildcard := sign(t, key, signer, newA("*.wild.example.", ipv4))
+		for _, rr := range wildcard {
+			rr.Header().Name = name
+		}
+		z.records[rrsetKey{name, dns.TypeA}] = wildcard
+	}
+	z.authority["y.wild.example."] = sign(t, key, signer, newNSEC("*.wild.example.", "zzz.example.", dns.TypeA))
+
+	subKey, subSigner := newZoneKey(t, "sub.example.")
+	z.add(t, key, signer, subKey.ToDS(dns.SHA256))
+	z.add(t, subKey, subSigner, subKey)
+	z.add(t, subKey, subSigner, newA("www.sub.example.", ipv4))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			q := r.Question[0]
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = z.records[rrsetKey{q.Name, q.Qtype}]
+			m.Ns = z.authority[q.Name]
+			if z.nxdomain[q.Name] {
+				m.Rcode = dns.RcodeNameError
+			}
+			// pretend to be validating resolver for signed names
+			m.AuthenticatedData = len(m.Answer) > 1
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	z.address = pc.LocalAddr().String()
+	return z
+}
+
+func TestDnssecValidate(t *testing.T) {
+	zone := startSignedZone(t)
+
+	config.Cfg.DnsHost = "test"
+	config.Cfg.DnsUseCache = false
+	config.Cfg.PreferIpv6 = false
+	config.Cfg.DnsDnssec = DnssecValidate
+	defer func() { config.Cfg.DnsDnssec = "" }()
+
+	for name, anchor := range map[string]string{
+		"DS":     zone.parent.ToDS(dns.SHA256).String(),
+		"DNSKEY": zone.parent.String(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			trustAnchor, err := ParseTrustAnchor(strings.NewReader(anchor), "anchor")
+			require.NoError(t, err)
+
+			resolver := &DNSResolver{
+				DNSClient:   new(dns.Client),
+				DNSAddress:  zone.address,
+				TrustAnchor: trustAnchor,
+			}
+
+			for _, name := range []string{"secure.example", "www.sub.example", "alias.example", "y.wild.example"} {
+				_, ip, err := resolver.Resolve(context.Background(), name)
+				assert.NoError(t, err, name)
+				assert.Equal(t, ipv4, ip.String(), name)
+			}
+
+			// negative answers with proof of nonexistence
+			for _, name := range []string{"missing.example", "nodata.example"} {
+				_, ip, err := resolver.Resolve(context.Background(), name)
+				assert.NoError(t, err, name)
+				assert.Nil(t, ip, name)
+			}
+
+			for _, name := range []string{"unsigned.example", "bogus.example", "bank.example", "forged.example", "x.wild.example"} {
+				_, ip, err := resolver.Resolve(context.Background(), name)
+				assert.True(t, errors.Is(err, ErrDnssecBogus), name)
+				assert.Nil(t, ip, name)
+			}
+		})
+	}
+}
+
+func TestDnssecAD(t *testing.T) {
+	zone := startSignedZone(t)
+
+	config.Cfg.DnsHost = "test"
+	config.Cfg.DnsUseCache = false
+	config.Cfg.PreferIpv6 = false
+	config.Cfg.DnsDnssec = DnssecAD
+	defer func() { config.Cfg.DnsDnssec = "" }()
+
+	resolver := &DNSResolver{
+		DNSClient:  new(dns.Client),
+		DNSAddress: zone.address,
+	}
+
+	_, ip, err := resolver.Resolve(context.Background(), "secure.example")
+	assert.NoError(t, err)
+	assert.Equal(t, ipv4, ip.String())
+
+	_, ip, err = resolver.Resolve(context.Background(), "unsigned.example")
+	assert.True(t, errors.Is(err, ErrDnssecBogus))
+	assert.Nil(t, ip)
+}
+
+func TestParseTrustAnchor(t *testing.T) {
+	anchor, err := ParseTrustAnchor(strings.NewReader(
+		". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D\n"), "root")
+	require.NoError(t, err)
+	assert.Len(t, anchor.ds["."], 1)
+
+	_, err = ParseTrustAnchor(strings.NewReader("example. IN A 192.168.2.1\n"), "bad")
+	assert.Error(t, err)
+
+	_, err = ParseTrustAnchor(strings.NewReader(""), "empty")
+	assert.Error(t, err)
+}
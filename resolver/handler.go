@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type responseCacheEntry struct {
+	Name      string   `json:"name"`
+	IPs       []string `json:"ips"`
+	Ttl       int64    `json:"ttl"`
+	Remaining int64    `json:"remaining"`
+	Negative  bool     `json:"negative"`
+	Stale     bool     `json:"stale"`
+	Hits      uint64   `json:"hits"`
+}
+
+type responseCache struct {
+	Count   int                  `json:"count"`
+	Stats   any                  `json:"stats"`
+	Entries []responseCacheEntry `json:"entries"`
+}
+
+func newResponseCacheEntry(name string, entry *cacheEntry, now time.Time) responseCacheEntry {
+	ips := make([]string, 0, len(entry.IPs))
+	for _, ip := range entry.IPs {
+		ips = append(ips, ip.String())
+	}
+
+	return responseCacheEntry{
+		Name:      name,
+		IPs:       ips,
+		Ttl:       int64(entry.TTL / time.Second),
+		Remaining: int64(entry.Expires.Sub(now) / time.Second),
+		Negative:  len(entry.IPs) == 0,
+		Stale:     !entry.fresh(now),
+		Hits:      entry.hits.Load(),
+	}
+}
+
+func writeJson(writer http.ResponseWriter, status int, response any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		slog.Error("Status write response", "err", err)
+	}
+}
+
+// CacheHandler returns status server endpoints for DNS cache inspection:
+//
+//	GET    /dns/cache        list cached names
+//	GET    /dns/cache/{name} show single name
+//	DELETE /dns/cache        flush whole cache
+//	DELETE /dns/cache/{name} flush single name
+func (d DNSResolver) CacheHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /dns/cache", d.serveCacheList)
+	mux.HandleFunc("GET /dns/cache/{name}", d.serveCacheEntry)
+	mux.HandleFunc("DELETE /dns/cache", d.serveCacheFlush)
+	mux.HandleFunc("DELETE /dns/cache/{name}", d.serveCacheFlush)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if d.Cache == nil {
+			writeJson(writer, http.StatusNotFound, map[string]string{"error": "dns cache disabled"})
+			return
+		}
+
+		mux.ServeHTTP(writer, request)
+	})
+}
+
+func (d DNSResolver) serveCacheList(writer http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	response := responseCache{
+		Stats:   d.Stats.Snapshot(),
+		Entries: []responseCacheEntry{},
+	}
+
+	for name, item := range d.Cache.Items() {
+		if entry, ok := item.Object.(*cacheEntry); ok {
+			response.Entries = append(response.Entries, newResponseCacheEntry(name, entry, now))
+		}
+	}
+
+	slices.SortFunc(response.Entries, func(a, b responseCacheEntry) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	response.Count = len(response.Entries)
+
+	writeJson(writer, http.StatusOK, response)
+}
+
+func (d DNSResolver) serveCacheEntry(writer http.ResponseWriter, request *http.Request) {
+	name := request.PathValue("name")
+
+	entry, found := d.cacheGet(name)
+	if !found {
+		writeJson(writer, http.StatusNotFound, map[string]string{"error": "name not cached"})
+		return
+	}
+
+	writeJson(writer, http.StatusOK, newResponseCacheEntry(name, entry, time.Now()))
+}
+
+func (d DNSResolver) serveCacheFlush(writer http.ResponseWriter, request *http.Request) {
+	name := request.PathValue("name")
+
+	var count int
+	if name == "" {
+		count = d.Cache.ItemCount()
+		d.Cache.Flush()
+	} else if _, found := d.Cache.Get(name); found {
+		count = 1
+		d.Cache.Delete(name)
+	}
+
+	slog.Info("DNS cache flush", "name", name, "count", count)
+	writeJson(writer, http.StatusOK, map[string]int{"flushed": count})
+}
@@ -2,8 +2,10 @@ package resolver
 
 import (
 	"context"
+	"fmt"
 	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
+	"golang.org/x/sync/singleflight"
 	"log/slog"
 	"math/rand/v2"
 	"net"
@@ -15,95 +17,275 @@ type DNSResolver struct {
 	Cache      *cache.Cache
 	DNSClient  *dns.Client
 	DNSAddress string
+	// Resolver is used when DNS_HOST is empty, nil means net.DefaultResolver
+	Resolver *net.Resolver
+	// TrustAnchor is required for DNS_DNSSEC=validate
+	TrustAnchor *TrustAnchor
+	// Group coalesces concurrent identical queries, nil disables coalescing
+	Group *singleflight.Group
+	Stats *Stats
+}
+
+// answer is the shared result of coalesced query
+type answer struct {
+	ips []net.IP
+	ttl uint32
 }
 
 func (d DNSResolver) getRandIp(ips []net.IP) net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
 	answerId := rand.IntN(len(ips))
 	return ips[answerId]
 }
 
-func (d DNSResolver) resolve(ctx context.Context, name string, t uint16) (result []net.IP, ttl uint32, err error) {
-	m := new(dns.Msg)
+// withTimeout limits lookup with DNS_TIMEOUT
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if config.Cfg.DnsTimeout > 0 {
+		return context.WithTimeout(ctx, config.Cfg.DnsTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// coalesce runs query for key. Concurrent calls with the same key share
+// single upstream query.
+func (d DNSResolver) coalesce(ctx context.Context, key string, query func(ctx context.Context) ([]net.IP, uint32, error)) ([]net.IP, uint32, error) {
+	if d.Group == nil {
+		d.Stats.query()
+		return query(ctx)
+	}
+
+	// only the caller which started the query runs the function
+	leader := false
+	ch := d.Group.DoChan(key, func() (any, error) {
+		leader = true
+		d.Stats.query()
+
+		// query must not be cancelled with the context of first caller
+		queryCtx, cancel := withTimeout(context.WithoutCancel(ctx))
+		defer cancel()
+
+		ips, ttl, err := query(queryCtx)
+		return answer{ips, ttl}, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case res := <-ch:
+		if !leader {
+			d.Stats.coalesce()
+			slog.Debug("Resolve coalesced", "key", key)
+		}
+
+		result := res.Val.(answer)
+		return result.ips, result.ttl, res.Err
+	}
+}
+
+// resolve queries DNSAddress for records of type t
+func (d DNSResolver) resolve(ctx context.Context, name string, t uint16) ([]net.IP, uint32, error) {
+	return d.coalesce(ctx, dns.TypeToString[t]+" "+name, func(ctx context.Context) ([]net.IP, uint32, error) {
+		return d.exchange(ctx, name, t)
+	})
+}
+
+// resolveSystem looks up name with system resolver. It does not provide
+// ttl, so answers are cached for DNS_SYSTEM_TTL.
+func (d DNSResolver) resolveSystem(ctx context.Context, name string) ([]net.IP, uint32, error) {
+	res := d.Resolver
+	if res == nil {
+		res = net.DefaultResolver
+	}
 
-	m.SetQuestion(dns.Fqdn(name), t)
-	m.RecursionDesired = true
+	ips, _, err := d.coalesce(ctx, "system "+name, func(ctx context.Context) ([]net.IP, uint32, error) {
+		addrs, err := res.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
 
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+
+		return ips, 0, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ipv4, ipv6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+
+	if config.Cfg.PreferIpv6 && len(ipv6) > 0 {
+		ips = ipv6
+	} else {
+		ips = ipv4
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no suitable address found", Name: name, IsNotFound: true}
+	}
+
+	return ips, uint32(config.Cfg.DnsSystemTtl / time.Second), nil
+}
+
+// exchangeMsg sends m to DNSAddress and retries over TCP when UDP answer is truncated
+func (d DNSResolver) exchangeMsg(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
 	r, _, err := d.DNSClient.ExchangeContext(ctx, m, d.DNSAddress)
-	if r == nil || r.Rcode != dns.RcodeSuccess {
+	if err == nil && r != nil && r.Truncated && d.DNSClient.Net == "" {
+		tcpClient := *d.DNSClient
+		tcpClient.Net = "tcp"
+		r, _, err = tcpClient.ExchangeContext(ctx, m, d.DNSAddress)
+	}
+
+	return r, err
+}
+
+// exchange queries DNSAddress for records of type t. Only addresses owned by
+// name or by targets of its CNAME chain are taken. For negative answers
+// (NXDOMAIN/NODATA) ttl is the negative caching ttl taken from SOA record
+// of authority section or 0 when upstream did not provide one.
+func (d DNSResolver) exchange(ctx context.Context, name string, t uint16) (result []net.IP, ttl uint32, err error) {
+	r, err := d.exchangeMsg(ctx, newQuery(name, t))
+	if err != nil {
 		return nil, 0, err
 	}
+	if r == nil {
+		return nil, 0, fmt.Errorf("dns: empty response for %s", name)
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, 0, fmt.Errorf("dns: %s for %s", dns.RcodeToString[r.Rcode], name)
+	}
+
+	chain, owner := answerChain(name, t, r.Answer)
+	for _, answer := range chain {
+		// skip CNAME chain and signatures
+		hdr := answer.Header()
+		if hdr.Rrtype != t {
+			continue
+		}
 
-	for _, answer := range r.Answer {
-		if t == dns.TypeA {
-			rec := answer.(*dns.A)
-			ttl = rec.Hdr.Ttl
+		switch rec := answer.(type) {
+		case *dns.A:
 			result = append(result, rec.A)
-		} else {
-			rec := answer.(*dns.AAAA)
-			ttl = rec.Hdr.Ttl
+		case *dns.AAAA:
 			result = append(result, rec.AAAA)
 		}
+
+		if len(result) == 1 || hdr.Ttl < ttl {
+			ttl = hdr.Ttl
+		}
+	}
+
+	if err := d.checkDnssec(ctx, owner, t, r, chain, len(result) > 0); err != nil {
+		return nil, 0, err
+	}
+
+	if len(result) == 0 {
+		ttl = 0
+		for _, ns := range r.Ns {
+			if soa, ok := ns.(*dns.SOA); ok {
+				ttl = min(soa.Hdr.Ttl, soa.Minttl)
+				break
+			}
+		}
 	}
 
 	return result, ttl, nil
 }
 
-// Resolve implement interface NameResolver
-func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+// lookup resolves name with respect of PREFER_IPV6
+func (d DNSResolver) lookup(ctx context.Context, name string) (ips []net.IP, ttl uint32, err error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
 	if len(config.Cfg.DnsHost) == 0 {
-		if config.Cfg.PreferIpv6 {
-			addr6, err := net.ResolveIPAddr("ip6", name)
-			if err == nil {
-				slog.Debug("Resolve", "name", name, "ip", addr6.IP)
+		return d.resolveSystem(ctx, name)
+	}
 
-				return ctx, addr6.IP, nil
-			}
+	if config.Cfg.PreferIpv6 {
+		ips, ttl, err = d.resolve(ctx, name, dns.TypeAAAA)
+		if err == nil && len(ips) > 0 {
+			return ips, ttl, nil
 		}
 
-		addr, err := net.ResolveIPAddr("ip4", name)
-		if err != nil {
-			return ctx, nil, err
+		negTtl := ttl
+		ips, ttl, err = d.resolve(ctx, name, dns.TypeA)
+		if err == nil && len(ips) == 0 {
+			ttl = min(ttl, negTtl)
 		}
 
-		slog.Debug("Resolve", "name", name, "ip", addr.IP)
-		return ctx, addr.IP, nil
+		return ips, ttl, err
 	}
 
-	if config.Cfg.DnsUseCache {
-		val, expiration, found := d.Cache.GetWithExpiration(name)
-		if found {
-			ip := d.getRandIp(val.([]net.IP))
-
-			slog.Debug("Resolve", "name", name, "cache", true, "expiration", expiration, "ip", ip)
+	return d.resolve(ctx, name, dns.TypeA)
+}
 
-			return ctx, ip, nil
-		}
+// prefetch refreshes cache entry in background before it expires
+func (d DNSResolver) prefetch(name string) {
+	ips, ttl, err := d.lookup(context.Background(), name)
+	if err != nil {
+		slog.Debug("Resolve prefetch", "name", name, "err", err)
+		return
 	}
 
-	var ttl uint32
-	var ips []net.IP
-	var err error
+	slog.Debug("Resolve prefetch", "name", name, "ttl", ttl, "ips", ips)
+	d.cacheSet(name, ips, ttl)
+}
 
-	if config.Cfg.PreferIpv6 {
-		ips, ttl, err = d.resolve(ctx, name, dns.TypeAAAA)
-		if err != nil || len(ips) == 0 {
-			ips, ttl, err = d.resolve(ctx, name, dns.TypeA)
-			if err != nil || len(ips) == 0 {
-				return ctx, nil, err
+// Resolve implement interface NameResolver
+func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	var stale *cacheEntry
+	if d.cacheEnabled() {
+		if entry, found := d.cacheGet(name); found {
+			now := time.Now()
+			entry.touch(now)
+
+			if entry.fresh(now) {
+				if entry.needPrefetch(now) {
+					go d.prefetch(name)
+				}
+
+				d.Stats.hit()
+				ip := d.getRandIp(entry.IPs)
+				slog.Debug("Resolve", "name", name, "cache", true, "expiration", entry.Expires, "ip", ip)
+
+				return ctx, ip, nil
 			}
+
+			stale = entry
 		}
-	} else {
-		ips, ttl, err = d.resolve(ctx, name, dns.TypeA)
-		if err != nil || len(ips) == 0 {
-			return ctx, nil, err
+		d.Stats.miss()
+	}
+
+	ips, ttl, err := d.lookup(ctx, name)
+	if err != nil {
+		if stale != nil {
+			d.Stats.staleHit()
+			ip := d.getRandIp(stale.IPs)
+			slog.Debug("Resolve", "name", name, "cache", true, "stale", true, "err", err, "ip", ip)
+
+			return ctx, ip, nil
 		}
+
+		return ctx, nil, err
 	}
 
 	ip := d.getRandIp(ips)
 	slog.Debug("Resolve", "name", name, "cache", false, "ttl", ttl, "ip", ip)
-	if config.Cfg.DnsUseCache {
-		d.Cache.Set(name, ips, time.Duration(ttl)*time.Second)
+	if d.cacheEnabled() {
+		d.cacheSet(name, ips, ttl)
 	}
 
-	return ctx, ip, err
+	return ctx, ip, nil
 }
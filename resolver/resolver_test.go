@@ -2,14 +2,21 @@ package resolver
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/foxcpp/go-mockdns"
 	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/sync/singleflight"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"rgosocks/config"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -70,7 +77,8 @@ func (suite *ResolverTestSuite) TestNameResolveIpv4() {
 	_, ip, err := resolver.Resolve(context.Background(), "1.example.com")
 	suite.NoError(err)
 
-	suite.Equal(ip.String(), ipv4)
+	// random address of multiple A records, same as custom DNS server
+	suite.Contains([]string{ipv4, "192.168.1.2"}, ip.String())
 }
 
 func (suite *ResolverTestSuite) TestNameResolveIpv4Miss() {
@@ -145,7 +153,7 @@ func (suite *ResolverTestSuite) TestNameResolveIpv4Custom() {
 
 	val, found := cacheDB.Get("4.example.com")
 	suite.Equal(found, true)
-	suite.Equal(val.([]net.IP)[0].String(), ipv4)
+	suite.Equal(val.(*cacheEntry).IPs[0].String(), ipv4)
 
 	_, ip, err = resolver.Resolve(context.Background(), "4.example.com")
 	suite.NoError(err)
@@ -155,7 +163,7 @@ func (suite *ResolverTestSuite) TestNameResolveIpv4Custom() {
 
 	val, found = cacheDB.Get("4.example.com")
 	suite.Equal(found, true)
-	suite.Equal(val.([]net.IP)[0].String(), ipv4)
+	suite.Equal(val.(*cacheEntry).IPs[0].String(), ipv4)
 }
 
 func (suite *ResolverTestSuite) TestNameResolveIpv4CustomNoCache() {
@@ -228,7 +236,7 @@ func (suite *ResolverTestSuite) TestNameResolveIpv6Custom() {
 
 	val, found := cacheDB.Get("4.example.com")
 	suite.Equal(found, true)
-	suite.Equal(val.([]net.IP)[0].String(), ipv6)
+	suite.Equal(val.(*cacheEntry).IPs[0].String(), ipv6)
 
 	_, ip, err = resolver.Resolve(context.Background(), "4.example.com")
 	suite.NoError(err)
@@ -238,7 +246,7 @@ func (suite *ResolverTestSuite) TestNameResolveIpv6Custom() {
 
 	val, found = cacheDB.Get("4.example.com")
 	suite.Equal(found, true)
-	suite.Equal(val.([]net.IP)[0].String(), ipv6)
+	suite.Equal(val.(*cacheEntry).IPs[0].String(), ipv6)
 }
 
 func (suite *ResolverTestSuite) TestNameResolveIpv6CustomТщСфсру() {
@@ -291,7 +299,7 @@ func (suite *ResolverTestSuite) TestNameResolveIpv6CustomMiss() {
 
 	val, found := cacheDB.Get("3.example.com")
 	suite.Equal(found, true)
-	suite.Equal(val.([]net.IP)[0].String(), ipv4)
+	suite.Equal(val.(*cacheEntry).IPs[0].String(), ipv4)
 }
 
 func (suite *ResolverTestSuite) TestNameResolveIpv6CustomMissNoCache() {
@@ -369,3 +377,294 @@ func (suite *ResolverTestSuite) TestNameResolveIpv4CustomNonExist() {
 	_, found := cacheDB.Get("nan.example.com")
 	suite.Equal(found, false)
 }
+
+func (suite *ResolverTestSuite) customResolver(cacheDB *cache.Cache) *DNSResolver {
+	addr, err := netip.ParseAddrPort(suite.srv.LocalAddr().String())
+	suite.Require().NoError(err)
+
+	config.Cfg.DnsHost = "test"
+	config.Cfg.DnsUseCache = true
+
+	return &DNSResolver{
+		Cache:      cacheDB,
+		DNSClient:  &dns.Client{Timeout: 200 * time.Millisecond},
+		DNSAddress: net.JoinHostPort(addr.Addr().String(), fmt.Sprintf("%d", addr.Port())),
+	}
+}
+
+func (suite *ResolverTestSuite) resetCacheConfig() {
+	config.Cfg.PreferIpv6 = false
+	config.Cfg.DnsCacheMaxEntries = 0
+	config.Cfg.DnsCacheMinTtl = 0
+	config.Cfg.DnsCacheMaxTtl = 0
+	config.Cfg.DnsCacheNegative = false
+	config.Cfg.DnsCachePrefetch = false
+	config.Cfg.DnsCacheStaleTtl = 0
+	config.Cfg.DnsSystemTtl = 0
+	config.Cfg.DnsTimeout = 0
+}
+
+func (suite *ResolverTestSuite) TestCacheNegative() {
+	defer suite.resetCacheConfig()
+	config.Cfg.DnsCacheNegative = true
+
+	cacheDB := cache.New(1*time.Minute, 3*time.Minute)
+	resolver := suite.customResolver(cacheDB)
+
+	_, ip, err := resolver.Resolve(context.Background(), "nan.example.com")
+	suite.NoError(err)
+	suite.Nil(ip)
+
+	val, expiration, found := cacheDB.GetWithExpiration("nan.example.com")
+	suite.True(found)
+	suite.Empty(val.(*cacheEntry).IPs)
+	// SOA minimum of mock server
+	suite.Equal(60*time.Second, val.(*cacheEntry).TTL)
+	suite.WithinDuration(time.Now().Add(60*time.Second), expiration, time.Second)
+
+	_, ip, err = resolver.Resolve(context.Background(), "nan.example.com")
+	suite.NoError(err)
+	suite.Nil(ip)
+	suite.Equal(uint64(1), val.(*cacheEntry).hits.Load())
+}
+
+func (suite *ResolverTestSuite) TestCacheTtlClamp() {
+	defer suite.resetCacheConfig()
+	config.Cfg.DnsCacheMaxTtl = 30 * time.Second
+
+	cacheDB := cache.New(1*time.Minute, 3*time.Minute)
+	resolver := suite.customResolver(cacheDB)
+
+	_, _, err := resolver.Resolve(context.Background(), "4.example.com")
+	suite.NoError(err)
+
+	val, found := cacheDB.Get("4.example.com")
+	suite.True(found)
+	suite.Equal(30*time.Second, val.(*cacheEntry).TTL)
+
+	config.Cfg.DnsCacheMinTtl = 10 * time.Second
+	suite.Equal(10*time.Second, clampTtl(1))
+}
+
+func (suite *ResolverTestSuite) TestCacheMaxEntries() {
+	defer suite.resetCacheConfig()
+	config.Cfg.DnsCacheMaxEntries = 2
+
+	cacheDB := cache.New(1*time.Minute, 3*time.Minute)
+	resolver := suite.customResolver(cacheDB)
+
+	for _, name := range []string{"1.example.com", "3.example.com", "1.example.com", "4.example.com"} {
+		_, _, err := resolver.Resolve(context.Background(), name)
+		suite.NoError(err)
+	}
+
+	suite.Equal(2, cacheDB.ItemCount())
+
+	_, found := cacheDB.Get("3.example.com")
+	suite.False(found, "least recently used entry must be evicted")
+
+	_, found = cacheDB.Get("1.example.com")
+	suite.True(found)
+}
+
+func (suite *ResolverTestSuite) TestCacheServeStale() {
+	defer suite.resetCacheConfig()
+	config.Cfg.DnsCacheStaleTtl = time.Minute
+
+	cacheDB := cache.New(1*time.Minute, 3*time.Minute)
+	resolver := suite.customResolver(cacheDB)
+
+	_, _, err := resolver.Resolve(context.Background(), "3.example.com")
+	suite.NoError(err)
+
+	val, found := cacheDB.Get("3.example.com")
+	suite.True(found)
+	val.(*cacheEntry).Expires = time.Now().Add(-time.Second)
+
+	// upstream is unreachable
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	defer pc.Close()
+	resolver.DNSAddress = pc.LocalAddr().String()
+
+	_, ip, err := resolver.Resolve(context.Background(), "3.example.com")
+	suite.NoError(err)
+	suite.Equal(ipv4, ip.String())
+
+	_, ip, err = resolver.Resolve(context.Background(), "1.example.com")
+	suite.Error(err)
+	suite.Nil(ip)
+}
+
+func (suite *ResolverTestSuite) TestCachePrefetch() {
+	defer suite.resetCacheConfig()
+	config.Cfg.DnsCachePrefetch = true
+
+	cacheDB := cache.New(1*time.Minute, 3*time.Minute)
+	resolver := suite.customResolver(cacheDB)
+
+	for range prefetchMinHits + 1 {
+		_, _, err := resolver.Resolve(context.Background(), "3.example.com")
+		suite.NoError(err)
+	}
+
+	val, found := cacheDB.Get("3.example.com")
+	suite.True(found)
+	old := val.(*cacheEntry)
+	old.Expires = time.Now().Add(time.Second)
+
+	_, ip, err := resolver.Resolve(context.Background(), "3.example.com")
+	suite.NoError(err)
+	suite.Equal(ipv4, ip.String())
+
+	suite.Eventually(func() bool {
+		val, found := cacheDB.Get("3.example.com")
+		return found && val.(*cacheEntry) != old
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *ResolverTestSuite) TestSystemCache() {
+	defer suite.resetCacheConfig()
+	config.Cfg.DnsHost = ""
+	config.Cfg.DnsUseCache = true
+	config.Cfg.DnsSystemTtl = time.Minute
+	config.Cfg.PreferIpv6 = true
+
+	cacheDB := cache.New(1*time.Minute, 3*time.Minute)
+	resolver := &DNSResolver{Cache: cacheDB}
+
+	_, ip, err := resolver.Resolve(context.Background(), "4.example.com")
+	suite.NoError(err)
+	suite.Equal(ipv6, ip.String())
+
+	val, found := cacheDB.Get("4.example.com")
+	suite.True(found)
+	suite.Equal(time.Minute, val.(*cacheEntry).TTL)
+	suite.Len(val.(*cacheEntry).IPs, 1)
+
+	_, _, err = resolver.Resolve(context.Background(), "nan.example.com")
+	suite.Error(err)
+	suite.Equal(1, cacheDB.ItemCount())
+}
+
+func (suite *ResolverTestSuite) TestSystemTimeout() {
+	defer suite.resetCacheConfig()
+	config.Cfg.DnsHost = ""
+	config.Cfg.DnsTimeout = 100 * time.Millisecond
+
+	resolver := &DNSResolver{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+		},
+	}
+
+	start := time.Now()
+	_, ip, err := resolver.Resolve(context.Background(), "4.example.com")
+	suite.Error(err)
+	suite.Nil(ip)
+	suite.Less(time.Since(start), time.Second)
+}
+
+func (suite *ResolverTestSuite) TestCacheHandler() {
+	defer suite.resetCacheConfig()
+
+	cacheDB := cache.New(1*time.Minute, 3*time.Minute)
+	resolver := suite.customResolver(cacheDB)
+	resolver.Stats = new(Stats)
+	handler := resolver.CacheHandler()
+
+	for _, name := range []string{"3.example.com", "4.example.com", "4.example.com"} {
+		_, _, err := resolver.Resolve(context.Background(), name)
+		suite.NoError(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns/cache", nil))
+	suite.Equal(http.StatusOK, rec.Code)
+
+	var list responseCache
+	suite.NoError(json.Unmarshal(rec.Body.Bytes(), &list))
+	suite.Equal(2, list.Count)
+	suite.Equal("3.example.com", list.Entries[0].Name)
+	suite.Equal([]string{ipv4}, list.Entries[0].IPs)
+	suite.Equal(uint64(1), list.Entries[1].Hits)
+	suite.InDelta(1.0/3, list.Stats.(map[string]any)["hitRatio"], 0.001)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns/cache/4.example.com", nil))
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.Contains(rec.Body.String(), `"name":"4.example.com"`)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/dns/cache/4.example.com", nil))
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.Equal(1, cacheDB.ItemCount())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dns/cache/4.example.com", nil))
+	suite.Equal(http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/dns/cache", nil))
+	suite.Equal(http.StatusOK, rec.Code)
+	suite.JSONEq(`{"flushed":1}`, rec.Body.String())
+	suite.Equal(0, cacheDB.ItemCount())
+}
+
+func TestResolveCoalesce(t *testing.T) {
+	var queries atomic.Int32
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			queries.Add(1)
+			// keep query in flight while other lookups arrive
+			time.Sleep(100 * time.Millisecond)
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ipv4),
+			})
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	config.Cfg.DnsHost = "test"
+	config.Cfg.DnsUseCache = false
+	config.Cfg.PreferIpv6 = false
+
+	resolver := &DNSResolver{
+		DNSClient:  new(dns.Client),
+		DNSAddress: pc.LocalAddr().String(),
+		Group:      new(singleflight.Group),
+		Stats:      new(Stats),
+	}
+
+	const callers = 20
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Go(func() {
+			_, ip, err := resolver.Resolve(context.Background(), "crawl.example.com")
+			assert.NoError(t, err)
+			assert.Equal(t, ipv4, ip.String())
+		})
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), queries.Load())
+	assert.Equal(t, uint64(1), resolver.Stats.Queries.Load())
+	assert.Equal(t, uint64(callers-1), resolver.Stats.Coalesced.Load())
+}
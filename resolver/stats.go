@@ -0,0 +1,80 @@
+package resolver
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds resolver counters exposed by status server.
+// All methods are safe to call on nil Stats.
+type Stats struct {
+	// Queries is the number of queries sent to upstream
+	Queries atomic.Uint64
+	// Coalesced is the number of lookups served by in-flight query of another caller
+	Coalesced atomic.Uint64
+	// CacheHits is the number of lookups answered from fresh cache entry
+	CacheHits atomic.Uint64
+	// CacheMisses is the number of lookups without fresh cache entry
+	CacheMisses atomic.Uint64
+	// StaleHits is the number of expired answers served because upstream failed
+	StaleHits atomic.Uint64
+}
+
+type responseStats struct {
+	Queries     uint64  `json:"queries"`
+	Coalesced   uint64  `json:"coalesced"`
+	CacheHits   uint64  `json:"cacheHits"`
+	CacheMisses uint64  `json:"cacheMisses"`
+	StaleHits   uint64  `json:"staleHits"`
+	HitRatio    float64 `json:"hitRatio"`
+}
+
+func (s *Stats) query() {
+	if s != nil {
+		s.Queries.Add(1)
+	}
+}
+
+func (s *Stats) coalesce() {
+	if s != nil {
+		s.Coalesced.Add(1)
+	}
+}
+
+func (s *Stats) hit() {
+	if s != nil {
+		s.CacheHits.Add(1)
+	}
+}
+
+func (s *Stats) miss() {
+	if s != nil {
+		s.CacheMisses.Add(1)
+	}
+}
+
+func (s *Stats) staleHit() {
+	if s != nil {
+		s.StaleHits.Add(1)
+	}
+}
+
+// Snapshot returns current counters for status response
+func (s *Stats) Snapshot() any {
+	if s == nil {
+		return responseStats{}
+	}
+
+	result := responseStats{
+		Queries:     s.Queries.Load(),
+		Coalesced:   s.Coalesced.Load(),
+		CacheHits:   s.CacheHits.Load(),
+		CacheMisses: s.CacheMisses.Load(),
+		StaleHits:   s.StaleHits.Load(),
+	}
+
+	if total := result.CacheHits + result.CacheMisses; total > 0 {
+		result.HitRatio = float64(result.CacheHits) / float64(total)
+	}
+
+	return result
+}
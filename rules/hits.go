@@ -0,0 +1,190 @@
+package rules
+
+import (
+	"cmp"
+	"rgosocks/geoip"
+	"rgosocks/script"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Hits counts requests decided by rule list entries. Only rule that decided
+// request is counted, like reject entry overriding matching allow entry.
+// All methods are safe to call on nil Hits.
+type Hits struct {
+	mu      sync.Mutex
+	entries map[hitKey]*hit
+}
+
+type hitKey struct {
+	rule  string
+	entry string
+}
+
+type hit struct {
+	allowed uint64
+	denied  uint64
+	last    time.Time
+}
+
+// EntryHits is counters of single rule list entry, entry is empty for
+// rules without list like disable_bind
+type EntryHits struct {
+	Rule    string    `json:"rule"`
+	Entry   string    `json:"entry,omitempty"`
+	Allowed uint64    `json:"allowed"`
+	Denied  uint64    `json:"denied"`
+	LastHit time.Time `json:"lastHit,omitzero"`
+}
+
+// HitsSummary is totals of rule set for status metrics
+type HitsSummary struct {
+	Entries int    `json:"entries"`
+	Unused  int    `json:"unused"`
+	Allowed uint64 `json:"allowed"`
+	Denied  uint64 `json:"denied"`
+}
+
+// record counts decision of rule, audited denials are counted as denied
+func (h *Hits) record(decision Decision, now time.Time) {
+	if h == nil || decision.Rule == "" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.entries == nil {
+		h.entries = make(map[hitKey]*hit)
+	}
+	key := hitKey{decision.Rule, decision.Entry}
+	entry, ok := h.entries[key]
+	if !ok {
+		entry = &hit{}
+		h.entries[key] = entry
+	}
+
+	if decision.Allowed {
+		entry.allowed++
+	} else {
+		entry.denied++
+	}
+	entry.last = now
+}
+
+func (h *Hits) get(rule, entry string) EntryHits {
+	result := EntryHits{Rule: rule, Entry: entry}
+	if h == nil {
+		return result
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if counters, ok := h.entries[hitKey{rule, entry}]; ok {
+		result.Allowed, result.Denied, result.LastHit = counters.allowed, counters.denied, counters.last
+	}
+
+	return result
+}
+
+// rule returns counters of hit entries of rule sorted by entry
+func (h *Hits) rule(rule string) []EntryHits {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var result []EntryHits
+	for key, counters := range h.entries {
+		if key.rule == rule {
+			result = append(result, EntryHits{Rule: rule, Entry: key.entry, Allowed: counters.allowed, Denied: counters.denied, LastHit: counters.last})
+		}
+	}
+	slices.SortFunc(result, func(a, b EntryHits) int {
+		return cmp.Compare(a.Entry, b.Entry)
+	})
+
+	return result
+}
+
+// HitReport returns counters of every entry of rule lists in order of
+// evaluation, entries without hits are included to find unused ones except
+// entries of list files
+func (r *ProxyRulesSet) HitReport() []EntryHits {
+	var report []EntryHits
+	for _, rule := range []string{RuleDisableBind, RuleDisableAssociate} {
+		if counters := r.Hits.get(rule, ""); counters.Allowed+counters.Denied > 0 {
+			report = append(report, counters)
+		}
+	}
+	for _, s := range r.Schedules {
+		report = append(report, r.Hits.get(RuleSchedule, s.String()))
+	}
+	for _, rule := range r.Script.Rules() {
+		if rule.Action == script.ActionAllow || rule.Action == script.ActionDeny {
+			report = append(report, r.Hits.get(RuleScript, rule.Text))
+		}
+	}
+
+	for _, entry := range r.AllowedFQDN {
+		report = append(report, r.Hits.get(RuleAllowedFQDN, entry))
+	}
+	for _, ipNet := range r.AllowedIPNet {
+		report = append(report, r.Hits.get(RuleAllowedIPs, ipNet.String()))
+	}
+	for _, entry := range r.RejectFQDN {
+		report = append(report, r.Hits.get(RuleRejectFQDN, entry))
+	}
+	for _, ipNet := range r.RejectIPNet {
+		report = append(report, r.Hits.get(RuleRejectIPs, ipNet.String()))
+	}
+	for _, entry := range r.AllowedCountries {
+		report = append(report, r.Hits.get(RuleAllowedCountries, entry))
+	}
+	for _, asn := range r.AllowedASNs {
+		report = append(report, r.Hits.get(RuleAllowedASNs, geoip.FormatASN(asn)))
+	}
+	for _, entry := range r.RejectCountries {
+		report = append(report, r.Hits.get(RuleRejectCountries, entry))
+	}
+	for _, asn := range r.RejectASNs {
+		report = append(report, r.Hits.get(RuleRejectASNs, geoip.FormatASN(asn)))
+	}
+	// entries of lists loaded from files are too many to report unused ones
+	report = append(report, r.Hits.rule(RuleAllowedLists)...)
+	report = append(report, r.Hits.rule(RuleRejectLists)...)
+	report = append(report, r.Hits.rule(RulePolicy)...)
+
+	return report
+}
+
+// SortHits orders report by denied or all hits, most hit entries first
+func SortHits(report []EntryHits, denied bool) {
+	slices.SortStableFunc(report, func(a, b EntryHits) int {
+		if denied {
+			return cmp.Compare(b.Denied, a.Denied)
+		}
+		return cmp.Compare(b.Allowed+b.Denied, a.Allowed+a.Denied)
+	})
+}
+
+// HitsSnapshot returns totals of rule set for status response
+func (r *ProxyRulesSet) HitsSnapshot() HitsSummary {
+	var summary HitsSummary
+	for _, entry := range r.HitReport() {
+		if entry.Entry != "" {
+			summary.Entries++
+			if entry.Allowed+entry.Denied == 0 {
+				summary.Unused++
+			}
+		}
+		summary.Allowed += entry.Allowed
+		summary.Denied += entry.Denied
+	}
+
+	return summary
+}
@@ -4,9 +4,48 @@ import (
 	"context"
 	"github.com/things-go/go-socks5"
 	"github.com/things-go/go-socks5/statute"
+	"log/slog"
 	"net"
+	"net/url"
+	"rgosocks/blocklist"
 	"rgosocks/config"
+	"rgosocks/geoip"
+	"rgosocks/policy"
+	"rgosocks/schedule"
+	"rgosocks/script"
 	"slices"
+	"time"
+)
+
+// Names of rules in decisions
+const (
+	RuleDisableBind      = "disable_bind"
+	RuleDisableAssociate = "disable_associate"
+	RuleAllowedFQDN      = "allowed_fqdn"
+	RuleAllowedIPs       = "allowed_ips"
+	RuleRejectFQDN       = "reject_fqdn"
+	RuleRejectIPs        = "reject_ips"
+	RuleAllowedCountries = "allowed_countries"
+	RuleAllowedASNs      = "allowed_asns"
+	RuleRejectCountries  = "reject_countries"
+	RuleRejectASNs       = "reject_asns"
+	RuleAllowedLists     = "allowed_lists"
+	RuleRejectLists      = "reject_lists"
+	RuleSchedule         = "schedule"
+	RulePolicy           = "policy"
+	RuleScript           = "script"
+)
+
+// Reasons of denials made when rule can not be evaluated
+const (
+	reasonScriptFailed = "script rule failed"
+	reasonPolicyFailed = "policy service failed"
+)
+
+// Entries of policy rule
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
 )
 
 type ProxyRulesSet struct {
@@ -14,44 +53,489 @@ type ProxyRulesSet struct {
 	RejectIPNet  []*net.IPNet
 	AllowedFQDN  []string
 	RejectFQDN   []string
+	// Countries are ISO 3166 codes in upper case, countries and ASNs of
+	// destination IP are looked up in GeoIP databases
+	AllowedCountries []string
+	RejectCountries  []string
+	AllowedASNs      []uint
+	RejectASNs       []uint
+	GeoIP            GeoLookup
+	// AllowedLists and RejectLists are domain and address lists of files or URLs
+	AllowedLists []*blocklist.List
+	RejectLists  []*blocklist.List
+	// Schedules deny requests of users outside of their schedules
+	Schedules schedule.Schedules
+	// Script decides requests by expressions before lists and selects their
+	// parent proxy and egress address, nil disables it
+	Script *script.Script
+	// Policy is asked about requests allowed by other rules, nil disables it
+	Policy *policy.Client
+	// now returns time of schedule and script checks, nil uses time.Now
+	now func() time.Time
+	// Audit logs denials of destination rules and permits requests
+	Audit bool
+	// Hits counts requests decided by entries of lists, nil disables counting
+	Hits *Hits
+}
+
+// GeoLookup finds country and ASN of IP address, implemented by geoip.DB
+type GeoLookup interface {
+	Lookup(ip net.IP) geoip.Info
+}
+
+// Decision is result of rules evaluation with rule that decided it
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Rule and Entry are matching rule and its list entry, empty when no rule matched
+	Rule  string `json:"rule,omitempty"`
+	Entry string `json:"entry,omitempty"`
+	// Source is file or URL of list containing Entry
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason"`
+	// Audited is set when denied request is permitted by audit mode
+	Audited bool `json:"audited,omitempty"`
+	// Country and ASN of destination IP when GeoIP databases are configured
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	// Parent and Egress route allowed request through parent proxy or from
+	// local address, they are selected by script rules
+	Parent *url.URL `json:"-"`
+	Egress net.IP   `json:"egress,omitempty"`
+	Trace  []Step   `json:"trace"`
+}
+
+// Step is evaluation of single rule
+type Step struct {
+	Rule    string `json:"rule"`
+	Entries int    `json:"entries"`
+	Match   bool   `json:"match"`
+	Entry   string `json:"entry,omitempty"`
+	Source  string `json:"source,omitempty"`
+	// Skipped is set when rule is not evaluated, like IP rules of unresolved FQDN
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// String describes decision for logs and errors
+func (d Decision) String() string {
+	if d.Source != "" {
+		return d.Reason + " (" + d.Rule + " " + d.Entry + " from " + d.Source + ")"
+	}
+	if d.Entry != "" {
+		return d.Reason + " (" + d.Rule + " " + d.Entry + ")"
+	}
+	if d.Rule != "" {
+		return d.Reason + " (" + d.Rule + ")"
+	}
+
+	return d.Reason
+}
+
+// Explainer evaluates rules with trace of every rule
+type Explainer interface {
+	Evaluate(ctx context.Context, req *socks5.Request) Decision
+}
+
+// Rechecker checks request allowed before again with more details of
+// destination, like hostname sniffed from tunnel data
+type Rechecker interface {
+	Recheck(ctx context.Context, req *socks5.Request) (context.Context, bool)
+}
+
+type decisionKey struct{}
+
+// DecisionFromContext returns decision stored in context by Allow
+func DecisionFromContext(ctx context.Context) (Decision, bool) {
+	decision, ok := ctx.Value(decisionKey{}).(Decision)
+	return decision, ok
 }
 
 func (r *ProxyRulesSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	decision := r.Evaluate(ctx, req)
+	r.Hits.record(decision, time.Now())
+
+	return r.decide(ctx, req, decision)
+}
+
+// Recheck evaluates request allowed by Allow again, e.g. with hostname sniffed
+// from tunnel. Policy service is not asked again and only denial is counted by
+// hits, so allowed tunnel is counted once.
+func (r *ProxyRulesSet) Recheck(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	decision := r.finish(r.evaluate(req))
+	if !decision.Allowed {
+		r.Hits.record(decision, time.Now())
+	}
+
+	return r.decide(ctx, req, decision)
+}
+
+// decide logs audited decision and stores it in context
+func (r *ProxyRulesSet) decide(ctx context.Context, req *socks5.Request, decision Decision) (context.Context, bool) {
+	if decision.Audited {
+		slog.Warn("Rule audit", "remote", req.RemoteAddr, "dest", req.DestAddr.Address(),
+			"rule", decision.Rule, "entry", decision.Entry, "reason", decision.Reason,
+			"country", decision.Country, "asn", decision.ASN)
+	}
+
+	return context.WithValue(ctx, decisionKey{}, decision), decision.Allowed || decision.Audited
+}
+
+// Evaluate checks request by all rules, denied request is marked audited in
+// audit mode. Policy service call is canceled with ctx.
+func (r *ProxyRulesSet) Evaluate(ctx context.Context, req *socks5.Request) Decision {
+	decision := r.evaluate(req)
+	if decision.Allowed && r.Policy != nil {
+		r.checkPolicy(ctx, &decision, req)
+	}
+
+	return r.finish(decision)
+}
+
+// finish clears route of denied decision and marks it audited in audit mode
+func (r *ProxyRulesSet) finish(decision Decision) Decision {
+	if !decision.Allowed {
+		decision.Parent, decision.Egress = nil, nil
+	}
+	decision.Audited = !decision.Allowed && r.Audit && auditable(decision)
+
+	return decision
+}
+
+// auditable reports whether denial is permitted in audit mode. Audit tries
+// destination rules, so disabled commands, schedules and failed rules deny
+// requests as usual.
+func auditable(decision Decision) bool {
+	switch decision.Rule {
+	case RuleDisableBind, RuleDisableAssociate, RuleSchedule:
+		return false
+	}
+
+	return decision.Reason != reasonScriptFailed && decision.Reason != reasonPolicyFailed
+}
+
+// evaluate checks allow lists first, reject lists override them
+func (r *ProxyRulesSet) evaluate(req *socks5.Request) Decision {
 	if config.Cfg.DisableBind && req.Command == statute.CommandBind {
-		return ctx, false
+		return Decision{
+			Rule:   RuleDisableBind,
+			Reason: "bind command is disabled",
+			Trace:  []Step{{Rule: RuleDisableBind, Match: true}},
+		}
 	}
 
 	if config.Cfg.DisableAssociate && req.Command == statute.CommandAssociate {
-		return ctx, false
+		return Decision{
+			Rule:   RuleDisableAssociate,
+			Reason: "associate command is disabled",
+			Trace:  []Step{{Rule: RuleDisableAssociate, Match: true}},
+		}
+	}
+
+	var steps []Step
+	if len(r.Schedules) > 0 {
+		step := r.scheduleStep(req)
+		if step.Match {
+			return Decision{
+				Rule:   RuleSchedule,
+				Entry:  step.Entry,
+				Reason: "request is outside of user schedule",
+				Trace:  []Step{step},
+			}
+		}
+		steps = append(steps, step)
 	}
 
-	result := len(r.AllowedFQDN) == 0 && len(r.AllowedIPNet) == 0
+	// country and ASN are recorded in decisions of script and lists
+	dest := req.DestAddr
+	var geo geoip.Info
+	if r.GeoIP != nil && dest.IP != nil {
+		geo = r.GeoIP.Lookup(dest.IP)
+	}
 
-	if !result && len(r.AllowedFQDN) > 0 && slices.Contains(r.AllowedFQDN, req.DestAddr.FQDN) {
-		result = true
+	var route Decision
+	if r.Script != nil {
+		decision, decided := r.evaluateScript(req)
+		decision.Trace = append(steps, decision.Trace...)
+		decision.Country, decision.ASN = geo.Country, geo.ASN
+		if decided {
+			return decision
+		}
+		route, steps = decision, decision.Trace
 	}
 
-	if !result && len(r.AllowedIPNet) > 0 {
-		for _, ipNet := range r.AllowedIPNet {
-			if ipNet.Contains(req.DestAddr.IP) {
-				result = true
-				break
-			}
+	allowedFQDN := fqdnStep(RuleAllowedFQDN, r.AllowedFQDN, dest)
+	allowedIPs := ipStep(RuleAllowedIPs, r.AllowedIPNet, dest)
+	rejectFQDN := fqdnStep(RuleRejectFQDN, r.RejectFQDN, dest)
+	rejectIPs := ipStep(RuleRejectIPs, r.RejectIPNet, dest)
+
+	decision := Decision{
+		Allowed: true,
+		Reason:  "no rule matched",
+		Parent:  route.Parent,
+		Egress:  route.Egress,
+		Country: geo.Country,
+		ASN:     geo.ASN,
+		Trace:   append(steps, allowedFQDN, allowedIPs, rejectFQDN, rejectIPs),
+	}
+	allowSteps := []Step{allowedFQDN, allowedIPs}
+	rejectSteps := []Step{rejectFQDN, rejectIPs}
+
+	// geo rules are traced only when configured
+	if len(r.AllowedCountries) > 0 || len(r.AllowedASNs) > 0 {
+		allowedCountries := geoStep(RuleAllowedCountries, r.AllowedCountries, decision.Country, dest)
+		allowedASNs := asnStep(RuleAllowedASNs, r.AllowedASNs, decision.ASN, dest)
+		allowSteps = append(allowSteps, allowedCountries, allowedASNs)
+		decision.Trace = append(decision.Trace, allowedCountries, allowedASNs)
+	}
+	if len(r.RejectCountries) > 0 || len(r.RejectASNs) > 0 {
+		rejectCountries := geoStep(RuleRejectCountries, r.RejectCountries, decision.Country, dest)
+		rejectASNs := asnStep(RuleRejectASNs, r.RejectASNs, decision.ASN, dest)
+		rejectSteps = append(rejectSteps, rejectCountries, rejectASNs)
+		decision.Trace = append(decision.Trace, rejectCountries, rejectASNs)
+	}
+
+	if len(r.AllowedLists) > 0 {
+		allowedLists := listStep(RuleAllowedLists, r.AllowedLists, dest)
+		allowSteps = append(allowSteps, allowedLists)
+		decision.Trace = append(decision.Trace, allowedLists)
+	}
+	if len(r.RejectLists) > 0 {
+		rejectLists := listStep(RuleRejectLists, r.RejectLists, dest)
+		rejectSteps = append(rejectSteps, rejectLists)
+		decision.Trace = append(decision.Trace, rejectLists)
+	}
+
+	if len(r.AllowedFQDN) > 0 || len(r.AllowedIPNet) > 0 || len(r.AllowedCountries) > 0 || len(r.AllowedASNs) > 0 ||
+		len(r.AllowedLists) > 0 {
+		index := slices.IndexFunc(allowSteps, func(step Step) bool { return step.Match })
+		if index < 0 {
+			decision.Allowed = false
+			decision.Reason = "destination is not in allow lists"
+			return decision
 		}
+		step := allowSteps[index]
+		decision.Rule, decision.Entry, decision.Source, decision.Reason = step.Rule, step.Entry, step.Source, "destination is in allow list"
 	}
 
-	if result && len(r.RejectFQDN) > 0 && slices.Contains(r.RejectFQDN, req.DestAddr.FQDN) {
-		result = false
+	for _, step := range rejectSteps {
+		if step.Match {
+			decision.Allowed = false
+			decision.Rule, decision.Entry, decision.Source, decision.Reason = step.Rule, step.Entry, step.Source, "destination is in reject list"
+			return decision
+		}
 	}
 
-	if result && len(r.RejectIPNet) > 0 {
-		for _, ipNet := range r.RejectIPNet {
-			if ipNet.Contains(req.DestAddr.IP) {
-				result = false
-				break
-			}
+	return decision
+}
+
+// evaluateScript runs script rules and reports whether allow or deny rule
+// decided request, decision holds route of matching parent and egress rules
+// and their trace. Failed rule denies request.
+func (r *ProxyRulesSet) evaluateScript(req *socks5.Request) (Decision, bool) {
+	fields := policyRequest(req)
+	result, err := r.Script.Evaluate(script.Request{
+		User:    fields.User,
+		Client:  fields.Client,
+		Command: fields.Command,
+		FQDN:    fields.FQDN,
+		IP:      fields.IP,
+		Port:    fields.Port,
+		Time:    r.clock(),
+	})
+
+	var decision Decision
+	for _, rule := range []*script.Rule{result.Parent, result.Egress} {
+		if rule != nil {
+			decision.Trace = append(decision.Trace, Step{Rule: RuleScript, Match: true, Entry: rule.Text, Source: rule.Source})
+		}
+	}
+	if result.Parent != nil {
+		decision.Parent = result.Parent.Parent
+	}
+	if result.Egress != nil {
+		decision.Egress = result.Egress.Egress
+	}
+
+	step := Step{Rule: RuleScript, Entries: len(r.Script.Rules())}
+	switch {
+	case err != nil:
+		slog.Error("Script", "remote", req.RemoteAddr, "dest", req.DestAddr.Address(), "err", err)
+		step.Match, step.Skipped = true, true
+		decision.Rule, decision.Reason = RuleScript, reasonScriptFailed
+	case result.Decision != nil:
+		step.Match, step.Entry, step.Source = true, result.Decision.Text, result.Decision.Source
+		decision.Allowed = result.Decision.Action == script.ActionAllow
+		decision.Rule, decision.Entry, decision.Source = RuleScript, step.Entry, step.Source
+		decision.Reason = "denied by script"
+		if decision.Allowed {
+			decision.Reason = "allowed by script"
+		}
+	}
+	decision.Trace = append(decision.Trace, step)
+
+	return decision, step.Match
+}
+
+// checkPolicy asks policy service about request allowed by other rules,
+// failed service decides by its fail mode. Entry of policy rule is allow or
+// deny, so hit counters are not keyed by reasons of service.
+func (r *ProxyRulesSet) checkPolicy(ctx context.Context, decision *Decision, req *socks5.Request) {
+	response, err := r.Policy.Decide(ctx, policyRequest(req))
+	step := Step{Rule: RulePolicy, Match: !response.Allow, Entry: policyAllow}
+	if !response.Allow {
+		step.Entry = policyDeny
+	}
+	if err != nil {
+		slog.Error("Policy", "remote", req.RemoteAddr, "dest", req.DestAddr.Address(), "allow", response.Allow, "err", err)
+		step.Entry, step.Skipped = "", true
+	}
+	decision.Trace = append(decision.Trace, step)
+
+	if !response.Allow {
+		decision.Allowed = false
+		decision.Rule, decision.Entry, decision.Source = RulePolicy, step.Entry, ""
+		switch {
+		case err != nil:
+			decision.Reason = reasonPolicyFailed
+		case response.Reason != "":
+			decision.Reason = "denied by policy service: " + response.Reason
+		default:
+			decision.Reason = "denied by policy service"
+		}
+	}
+}
+
+func policyRequest(req *socks5.Request) policy.Request {
+	result := policy.Request{
+		FQDN: req.DestAddr.FQDN,
+		Port: req.DestAddr.Port,
+	}
+	if req.AuthContext != nil {
+		result.User = req.AuthContext.Payload["username"]
+	}
+	if req.RemoteAddr != nil {
+		result.Client = req.RemoteAddr.String()
+		if host, _, err := net.SplitHostPort(result.Client); err == nil {
+			result.Client = host
+		}
+	}
+	if req.DestAddr.IP != nil {
+		result.IP = req.DestAddr.IP.String()
+	}
+
+	switch req.Command {
+	case statute.CommandConnect:
+		result.Command = "connect"
+	case statute.CommandBind:
+		result.Command = "bind"
+	case statute.CommandAssociate:
+		result.Command = "associate"
+	}
+
+	return result
+}
+
+// scheduleStep matches when request time is outside of all schedules of user
+func (r *ProxyRulesSet) scheduleStep(req *socks5.Request) Step {
+	var user string
+	if req.AuthContext != nil {
+		user = req.AuthContext.Payload["username"]
+	}
+
+	step := Step{Rule: RuleSchedule, Entries: len(r.Schedules)}
+	if s, outside := r.Schedules.Outside(user, r.clock()); outside {
+		step.Match, step.Entry = true, s.String()
+	}
+
+	return step
+}
+
+// clock returns time of schedule and script checks
+func (r *ProxyRulesSet) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+
+	return time.Now()
+}
+
+func fqdnStep(rule string, list []string, dest *statute.AddrSpec) Step {
+	step := Step{Rule: rule, Entries: len(list)}
+	if dest.FQDN == "" {
+		step.Skipped = len(list) > 0
+		return step
+	}
+
+	if slices.Contains(list, dest.FQDN) {
+		step.Match, step.Entry = true, dest.FQDN
+	}
+
+	return step
+}
+
+func ipStep(rule string, list []*net.IPNet, dest *statute.AddrSpec) Step {
+	step := Step{Rule: rule, Entries: len(list)}
+	if dest.IP == nil {
+		step.Skipped = len(list) > 0
+		return step
+	}
+
+	for _, ipNet := range list {
+		if ipNet.Contains(dest.IP) {
+			step.Match, step.Entry = true, ipNet.String()
+			break
+		}
+	}
+
+	return step
+}
+
+func geoStep(rule string, list []string, country string, dest *statute.AddrSpec) Step {
+	step := Step{Rule: rule, Entries: len(list)}
+	if dest.IP == nil {
+		step.Skipped = len(list) > 0
+		return step
+	}
+
+	if country != "" && slices.Contains(list, country) {
+		step.Match, step.Entry = true, country
+	}
+
+	return step
+}
+
+func asnStep(rule string, list []uint, asn uint, dest *statute.AddrSpec) Step {
+	step := Step{Rule: rule, Entries: len(list)}
+	if dest.IP == nil {
+		step.Skipped = len(list) > 0
+		return step
+	}
+
+	if asn != 0 && slices.Contains(list, asn) {
+		step.Match, step.Entry = true, geoip.FormatASN(asn)
+	}
+
+	return step
+}
+
+// listStep matches FQDN and IP of destination, lists are checked in order
+func listStep(rule string, lists []*blocklist.List, dest *statute.AddrSpec) Step {
+	step := Step{Rule: rule}
+	for _, list := range lists {
+		step.Entries += list.Len()
+	}
+
+	for _, list := range lists {
+		if dest.FQDN != "" {
+			step.Entry, step.Match = list.MatchFQDN(dest.FQDN)
+		}
+		if !step.Match && dest.IP != nil {
+			step.Entry, step.Match = list.MatchIP(dest.IP)
+		}
+		if step.Match {
+			step.Source = list.Source
+			break
 		}
 	}
 
-	return ctx, result
+	return step
 }
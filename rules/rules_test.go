@@ -2,12 +2,26 @@ package rules
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/things-go/go-socks5"
 	"github.com/things-go/go-socks5/statute"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rgosocks/blocklist"
 	"rgosocks/config"
+	"rgosocks/geoip"
+	"rgosocks/policy"
+	"rgosocks/schedule"
+	"rgosocks/script"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type setupRule struct {
@@ -214,3 +228,370 @@ func TestDisableAssociate(t *testing.T) {
 
 	assert.False(t, result)
 }
+
+func TestDecision(t *testing.T) {
+	rules, req := getConnectRules(&setupRule{
+		reqFQDN:     "example.com",
+		reqIp:       "192.168.1.1",
+		allowedFQDN: []string{"example.com"},
+		rejectNet:   []string{"10.0.0.0/8", "192.168.0.0/16"},
+	})
+
+	ctx, result := rules.Allow(context.Background(), req)
+	assert.False(t, result)
+
+	decision, ok := DecisionFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, RuleRejectIPs, decision.Rule)
+	assert.Equal(t, "192.168.0.0/16", decision.Entry)
+	assert.Equal(t, "destination is in reject list (reject_ips 192.168.0.0/16)", decision.String())
+	assert.Equal(t, []Step{
+		{Rule: RuleAllowedFQDN, Entries: 1, Match: true, Entry: "example.com"},
+		{Rule: RuleAllowedIPs},
+		{Rule: RuleRejectFQDN},
+		{Rule: RuleRejectIPs, Entries: 2, Match: true, Entry: "192.168.0.0/16"},
+	}, decision.Trace)
+}
+
+func TestDecisionUnresolved(t *testing.T) {
+	rules, req := getConnectRules(&setupRule{
+		reqFQDN:    "example.com",
+		allowedNet: []string{"192.168.0.0/16"},
+	})
+
+	decision := rules.Evaluate(context.Background(), req)
+
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "destination is not in allow lists", decision.Reason)
+	assert.True(t, decision.Trace[1].Skipped)
+}
+
+func TestAudit(t *testing.T) {
+	rules, req := getConnectRules(&setupRule{
+		reqIp:     "192.168.1.1",
+		rejectNet: []string{"192.168.1.0/24"},
+	})
+	rules.Audit = true
+
+	ctx, result := rules.Allow(context.Background(), req)
+
+	assert.True(t, result)
+	decision, _ := DecisionFromContext(ctx)
+	assert.False(t, decision.Allowed)
+	assert.True(t, decision.Audited)
+
+	// disabled commands are denied in audit mode
+	config.Cfg.DisableBind = true
+	defer func() { config.Cfg.DisableBind = false }()
+	req.Command = statute.CommandBind
+	_, result = rules.Allow(context.Background(), req)
+	assert.False(t, result)
+	assert.False(t, rules.Evaluate(context.Background(), req).Audited)
+}
+
+func TestHits(t *testing.T) {
+	rules, req := getConnectRules(&setupRule{
+		reqFQDN:     "example.com",
+		reqIp:       "10.1.1.1",
+		allowedFQDN: []string{"example.com", "unused.example"},
+		rejectNet:   []string{"10.0.0.0/8"},
+	})
+	rules.Hits = new(Hits)
+
+	rules.Allow(context.Background(), req)
+	req.DestAddr.IP = net.ParseIP("192.168.1.1")
+	rules.Allow(context.Background(), req)
+	rules.Allow(context.Background(), req)
+
+	report := rules.HitReport()
+	assert.Len(t, report, 3)
+	assert.Equal(t, EntryHits{Rule: RuleAllowedFQDN, Entry: "unused.example"}, report[1])
+	assert.Equal(t, uint64(2), report[0].Allowed)
+	assert.False(t, report[0].LastHit.IsZero())
+	assert.Equal(t, RuleRejectIPs, report[2].Rule)
+	assert.Equal(t, "10.0.0.0/8", report[2].Entry)
+	assert.Equal(t, uint64(1), report[2].Denied)
+
+	SortHits(report, true)
+	assert.Equal(t, "10.0.0.0/8", report[0].Entry)
+
+	assert.Equal(t, HitsSummary{Entries: 3, Unused: 1, Allowed: 2, Denied: 1}, rules.HitsSnapshot())
+}
+
+type geoLookup map[string]geoip.Info
+
+func (g geoLookup) Lookup(ip net.IP) geoip.Info {
+	return g[ip.String()]
+}
+
+func TestGeo(t *testing.T) {
+	rules, req := getConnectRules(&setupRule{
+		reqFQDN:     "example.com",
+		reqIp:       "192.0.2.1",
+		allowedFQDN: []string{"intranet.example"},
+	})
+	rules.AllowedCountries = []string{"DE", "NL"}
+	rules.RejectASNs = []uint{64500}
+	rules.GeoIP = geoLookup{
+		"192.0.2.1":    {Country: "DE", ASN: 64496},
+		"192.0.2.2":    {Country: "NL", ASN: 64500},
+		"198.51.100.1": {Country: "RU"},
+	}
+
+	decision := rules.Evaluate(context.Background(), req)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, RuleAllowedCountries, decision.Rule)
+	assert.Equal(t, "DE", decision.Entry)
+	assert.Equal(t, "DE", decision.Country)
+	assert.Equal(t, uint(64496), decision.ASN)
+	assert.Len(t, decision.Trace, 8)
+
+	req.DestAddr.IP = net.ParseIP("192.0.2.2")
+	decision = rules.Evaluate(context.Background(), req)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "destination is in reject list (reject_asns AS64500)", decision.String())
+
+	req.DestAddr.IP = net.ParseIP("198.51.100.1")
+	decision = rules.Evaluate(context.Background(), req)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "destination is not in allow lists", decision.Reason)
+
+	// unresolved FQDN is checked by FQDN rules only
+	req.DestAddr.IP = nil
+	req.DestAddr.FQDN = "intranet.example"
+	decision = rules.Evaluate(context.Background(), req)
+	assert.True(t, decision.Allowed)
+	assert.True(t, decision.Trace[4].Skipped)
+
+	// request decided by script carries country and ASN too
+	path := filepath.Join(t.TempDir(), "rules.cel")
+	require.NoError(t, os.WriteFile(path, []byte("allow true\n"), 0o644))
+	s, err := script.Load(path)
+	require.NoError(t, err)
+	rules.Script = s
+	req.DestAddr.IP = net.ParseIP("192.0.2.2")
+	decision = rules.Evaluate(context.Background(), req)
+	assert.Equal(t, RuleScript, decision.Rule)
+	assert.Equal(t, "NL", decision.Country)
+	assert.Equal(t, uint(64500), decision.ASN)
+}
+
+func TestLists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("||ads.example^\n10.0.0.0/8\n"), 0o600))
+	list, err := blocklist.Load(context.Background(), path, nil)
+	require.NoError(t, err)
+
+	rules, req := getConnectRules(&setupRule{
+		reqFQDN: "cdn.ads.example",
+		reqIp:   "192.0.2.1",
+	})
+	rules.RejectLists = []*blocklist.List{list}
+	rules.Hits = new(Hits)
+
+	_, result := rules.Allow(context.Background(), req)
+	assert.False(t, result)
+	decision := rules.Evaluate(context.Background(), req)
+	assert.Equal(t, "destination is in reject list (reject_lists *.ads.example from "+path+")", decision.String())
+	assert.Equal(t, Step{Rule: RuleRejectLists, Entries: 2, Match: true, Entry: "*.ads.example", Source: path}, decision.Trace[4])
+
+	req.DestAddr.FQDN = "example.com"
+	assert.True(t, rules.Evaluate(context.Background(), req).Allowed)
+	req.DestAddr.IP = net.ParseIP("10.2.3.4")
+	assert.Equal(t, "10.0.0.0/8", rules.Evaluate(context.Background(), req).Entry)
+
+	report := rules.HitReport()
+	require.Len(t, report, 1)
+	assert.Equal(t, "*.ads.example", report[0].Entry)
+	assert.Equal(t, uint64(1), report[0].Denied)
+}
+
+func TestSchedule(t *testing.T) {
+	rules, req := getConnectRules(&setupRule{
+		reqIp:       "192.0.2.1",
+		allowedFQDN: []string{"example.com"},
+	})
+	req.AuthContext = &socks5.AuthContext{Payload: map[string]string{"username": "alice"}}
+	businessHours, err := schedule.Parse([]string{"alice"}, []string{"mon-fri"}, []string{"09:00-18:00"}, "UTC", true)
+	require.NoError(t, err)
+	rules.Schedules = schedule.Schedules{businessHours}
+
+	rules.now = func() time.Time { return time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC) }
+	decision := rules.Evaluate(context.Background(), req)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "request is outside of user schedule (schedule alice mon,tue,wed,thu,fri 09:00-18:00 UTC)", decision.String())
+
+	// other rules are evaluated inside of schedule
+	rules.now = func() time.Time { return time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC) }
+	decision = rules.Evaluate(context.Background(), req)
+	assert.Equal(t, "destination is not in allow lists", decision.Reason)
+	assert.Equal(t, Step{Rule: RuleSchedule, Entries: 1}, decision.Trace[0])
+
+	req.AuthContext.Payload["username"] = "bob"
+	rules.now = func() time.Time { return time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC) }
+	assert.Equal(t, "destination is not in allow lists", rules.Evaluate(context.Background(), req).Reason)
+}
+
+func TestPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req policy.Request
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case req.User != "alice" || req.Client != "198.51.100.7" || req.Command != "connect":
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		case strings.HasSuffix(req.FQDN, "example.org"):
+			_ = json.NewEncoder(w).Encode(policy.Response{Allow: false, Reason: "quota exceeded by " + req.FQDN})
+		default:
+			_ = json.NewEncoder(w).Encode(policy.Response{Allow: true})
+		}
+	}))
+	defer server.Close()
+
+	rules, req := getConnectRules(&setupRule{
+		reqFQDN:    "example.org",
+		rejectFQDN: []string{"blocked.example.com"},
+	})
+	req.AuthContext = &socks5.AuthContext{Payload: map[string]string{"username": "alice"}}
+	req.RemoteAddr = &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000}
+	rules.Policy = &policy.Client{URL: server.URL}
+	rules.Hits = &Hits{}
+
+	decision := rules.Evaluate(context.Background(), req)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "denied by policy service: quota exceeded by example.org (policy deny)", decision.String())
+	assert.Equal(t, Step{Rule: RulePolicy, Match: true, Entry: "deny"}, decision.Trace[len(decision.Trace)-1])
+
+	// hits of policy are not counted by reasons of service
+	rules.Allow(context.Background(), req)
+	req.DestAddr.FQDN = "www.example.org"
+	rules.Allow(context.Background(), req)
+	report := rules.HitReport()
+	require.Len(t, report, 2)
+	assert.Equal(t, EntryHits{Rule: RulePolicy, Entry: "deny", Denied: 2, LastHit: report[1].LastHit}, report[1])
+
+	req.DestAddr.FQDN = "example.com"
+	decision = rules.Evaluate(context.Background(), req)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, Step{Rule: RulePolicy, Entry: "allow"}, decision.Trace[len(decision.Trace)-1])
+
+	// service is not asked about denied requests
+	req.DestAddr.FQDN = "blocked.example.com"
+	decision = rules.Evaluate(context.Background(), req)
+	assert.Equal(t, RuleRejectFQDN, decision.Rule)
+	assert.NotContains(t, decision.Trace, Step{Rule: RulePolicy})
+
+	// failed service decides by fail mode
+	req.DestAddr.FQDN = "example.net"
+	req.AuthContext.Payload["username"] = "bob"
+	decision = rules.Evaluate(context.Background(), req)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "policy service failed (policy)", decision.String())
+	assert.Equal(t, Step{Rule: RulePolicy, Match: true, Skipped: true}, decision.Trace[len(decision.Trace)-1])
+
+	rules.Policy.FailOpen = true
+	assert.True(t, rules.Evaluate(context.Background(), req).Allowed)
+
+	// canceled request does not wait for service
+	rules.Policy.FailOpen = false
+	req.AuthContext.Payload["username"] = "alice"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, reasonPolicyFailed, rules.Evaluate(ctx, req).Reason)
+}
+
+func TestRecheck(t *testing.T) {
+	var asked atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked.Add(1)
+		_ = json.NewEncoder(w).Encode(policy.Response{Allow: true})
+	}))
+	defer server.Close()
+
+	rules, req := getConnectRules(&setupRule{
+		reqIp:      "192.0.2.10",
+		allowedNet: []string{"192.0.2.0/24"},
+		rejectFQDN: []string{"blocked.example"},
+	})
+	rules.Policy = &policy.Client{URL: server.URL}
+	rules.Hits = &Hits{}
+
+	_, ok := rules.Allow(context.Background(), req)
+	assert.True(t, ok)
+
+	// allowed recheck is neither counted nor sent to service again
+	sniffed := *req
+	sniffed.DestAddr = &statute.AddrSpec{FQDN: "allowed.example", IP: req.DestAddr.IP}
+	ctx, ok := rules.Recheck(context.Background(), &sniffed)
+	assert.True(t, ok)
+	decision, found := DecisionFromContext(ctx)
+	require.True(t, found)
+	assert.Equal(t, RuleAllowedIPs, decision.Rule)
+	assert.Equal(t, int32(1), asked.Load())
+
+	// denied recheck is counted by entry that denied it
+	sniffed.DestAddr = &statute.AddrSpec{FQDN: "blocked.example", IP: req.DestAddr.IP}
+	_, ok = rules.Recheck(context.Background(), &sniffed)
+	assert.False(t, ok)
+	assert.Equal(t, int32(1), asked.Load())
+
+	report := rules.HitReport()
+	require.Len(t, report, 2)
+	assert.Equal(t, EntryHits{Rule: RuleAllowedIPs, Entry: "192.0.2.0/24", Allowed: 1, LastHit: report[0].LastHit}, report[0])
+	assert.Equal(t, EntryHits{Rule: RuleRejectFQDN, Entry: "blocked.example", Denied: 1, LastHit: report[1].LastHit}, report[1])
+}
+
+func TestScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.cel")
+	require.NoError(t, os.WriteFile(path, []byte(`parent socks5://192.0.2.1:1080 fqdn.endsWith(".corp.example")
+egress 198.51.100.10 user == "bob"
+deny port == 25
+allow user == "alice"
+deny port == 0
+`), 0o644))
+	s, err := script.Load(path)
+	require.NoError(t, err)
+
+	rules, req := getConnectRules(&setupRule{
+		reqFQDN:     "git.corp.example",
+		allowedFQDN: []string{"example.com"},
+	})
+	req.DestAddr.Port = 443
+	req.AuthContext = &socks5.AuthContext{Payload: map[string]string{"username": "alice"}}
+	rules.Script = s
+	rules.Hits = &Hits{}
+
+	// script allows request not in allow lists and routes it through parent
+	decision := rules.Evaluate(context.Background(), req)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, `allowed by script (script allow user == "alice" from `+path+`:4)`, decision.String())
+	assert.Equal(t, "192.0.2.1:1080", decision.Parent.Host)
+	assert.Nil(t, decision.Egress)
+	assert.Equal(t, []Step{
+		{Rule: RuleScript, Match: true, Entry: "parent socks5://192.0.2.1:1080 fqdn.endsWith(\".corp.example\")", Source: path + ":1"},
+		{Rule: RuleScript, Entries: 5, Match: true, Entry: `allow user == "alice"`, Source: path + ":4"},
+	}, decision.Trace)
+
+	// request not decided by script is checked by lists with route of script
+	req.AuthContext.Payload["username"] = "bob"
+	req.DestAddr.FQDN = "example.com"
+	decision = rules.Evaluate(context.Background(), req)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, RuleAllowedFQDN, decision.Rule)
+	assert.Equal(t, "198.51.100.10", decision.Egress.String())
+
+	req.DestAddr.FQDN = "example.org"
+	decision = rules.Evaluate(context.Background(), req)
+	assert.False(t, decision.Allowed)
+	assert.Nil(t, decision.Egress)
+
+	req.DestAddr.Port = 25
+	rules.Allow(context.Background(), req)
+	decision = rules.Evaluate(context.Background(), req)
+	assert.Equal(t, "denied by script (script deny port == 25 from "+path+":3)", decision.String())
+
+	report := rules.HitReport()
+	require.Len(t, report, 4)
+	assert.Equal(t, EntryHits{Rule: RuleScript, Entry: "deny port == 25", Denied: 1, LastHit: report[0].LastHit}, report[0])
+	assert.False(t, report[0].LastHit.IsZero())
+	assert.Equal(t, EntryHits{Rule: RuleScript, Entry: "deny port == 0"}, report[2])
+}
@@ -0,0 +1,203 @@
+package schedule
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Window is time of day from From to To in minutes after midnight, window
+// with To not after From spans midnight
+type Window struct {
+	From, To int
+}
+
+// Schedule is days of week and time windows in timezone when users may use proxy
+type Schedule struct {
+	// Users are usernames of schedule, empty Users apply to all requests
+	Users []string
+	// Days are allowed days of week by time.Weekday
+	Days     [7]bool
+	Windows  []Window
+	Location *time.Location
+	// Cut closes connections of users when window closes
+	Cut bool
+}
+
+// Parse builds schedule of config values, empty days mean every day and
+// empty hours mean whole day
+func Parse(users, days, hours []string, timezone string, cut bool) (Schedule, error) {
+	s := Schedule{Users: users, Cut: cut}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return s, err
+	}
+	s.Location = location
+
+	if len(days) == 0 {
+		days = []string{"sun-sat"}
+	}
+	for _, day := range days {
+		from, to, err := ParseDays(day)
+		if err != nil {
+			return s, err
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			s.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	if len(hours) == 0 {
+		hours = []string{"00:00-24:00"}
+	}
+	for _, hour := range hours {
+		window, err := ParseWindow(hour)
+		if err != nil {
+			return s, err
+		}
+		s.Windows = append(s.Windows, window)
+	}
+
+	return s, nil
+}
+
+// ParseDays parses day like mon or range of days like mon-fri, range may
+// wrap over week end like fri-mon
+func ParseDays(text string) (time.Weekday, time.Weekday, error) {
+	fromText, toText, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(text)), "-")
+	from := slices.Index(dayNames, fromText)
+	to := from
+	if isRange {
+		to = slices.Index(dayNames, toText)
+	}
+	if from < 0 || to < 0 {
+		return 0, 0, fmt.Errorf("invalid days %q, expected day like mon or range like mon-fri", text)
+	}
+
+	return time.Weekday(from), time.Weekday(to), nil
+}
+
+// ParseWindow parses time window like 09:00-18:00, window like 22:00-06:00 spans midnight
+func ParseWindow(text string) (Window, error) {
+	fromText, toText, ok := strings.Cut(strings.TrimSpace(text), "-")
+	from, fromErr := parseMinutes(fromText)
+	to, toErr := parseMinutes(toText)
+	if !ok || fromErr != nil || toErr != nil || from == 24*60 || from == to {
+		return Window{}, fmt.Errorf("invalid time window %q, expected window like 09:00-18:00", text)
+	}
+
+	return Window{From: from, To: to}, nil
+}
+
+func parseMinutes(text string) (int, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(text, "%d:%d", &hour, &minute); err != nil || n != 2 || len(text) != 5 {
+		return 0, fmt.Errorf("invalid time %q", text)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || hour == 24 && minute != 0 {
+		return 0, fmt.Errorf("invalid time %q", text)
+	}
+
+	return hour*60 + minute, nil
+}
+
+// AppliesTo reports whether schedule restricts user
+func (s Schedule) AppliesTo(user string) bool {
+	return len(s.Users) == 0 || slices.Contains(s.Users, user)
+}
+
+// Active reports whether t is in window of schedule, part of window after
+// midnight belongs to day when window started
+func (s Schedule) Active(t time.Time) bool {
+	if s.Location != nil {
+		t = t.In(s.Location)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+
+	for _, w := range s.Windows {
+		if w.From < w.To {
+			if s.Days[today] && minute >= w.From && minute < w.To {
+				return true
+			}
+			continue
+		}
+		if s.Days[today] && minute >= w.From || s.Days[yesterday] && minute < w.To {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String describes schedule for rule decisions, like "alice mon-fri 09:00-18:00 Europe/Berlin"
+func (s Schedule) String() string {
+	users := "*"
+	if len(s.Users) > 0 {
+		users = strings.Join(s.Users, ",")
+	}
+
+	var days []string
+	for d, ok := range s.Days {
+		if ok {
+			days = append(days, dayNames[d])
+		}
+	}
+
+	var windows []string
+	for _, w := range s.Windows {
+		windows = append(windows, fmt.Sprintf("%02d:%02d-%02d:%02d", w.From/60, w.From%60, w.To/60, w.To%60))
+	}
+
+	location := "Local"
+	if s.Location != nil {
+		location = s.Location.String()
+	}
+
+	return users + " " + strings.Join(days, ",") + " " + strings.Join(windows, ",") + " " + location
+}
+
+// Schedules restrict users by all schedules applying to them
+type Schedules []Schedule
+
+// Outside returns first schedule applying to user when t is outside of all
+// schedules of user, users without schedules are never outside
+func (s Schedules) Outside(user string, t time.Time) (Schedule, bool) {
+	var first *Schedule
+	for i := range s {
+		if !s[i].AppliesTo(user) {
+			continue
+		}
+		if s[i].Active(t) {
+			return Schedule{}, false
+		}
+		if first == nil {
+			first = &s[i]
+		}
+	}
+
+	if first == nil {
+		return Schedule{}, false
+	}
+
+	return *first, true
+}
+
+// Cut reports whether connections of user are closed at t, when user is
+// outside of schedules and any of them closes connections
+func (s Schedules) Cut(user string, t time.Time) bool {
+	if _, outside := s.Outside(user, t); !outside {
+		return false
+	}
+
+	return slices.ContainsFunc(s, func(schedule Schedule) bool {
+		return schedule.Cut && schedule.AppliesTo(user)
+	})
+}
@@ -0,0 +1,77 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]string{"alice"}, []string{"mon-wed", "fri"}, []string{"09:00-12:00", "13:00-18:00"}, "Europe/Berlin", true)
+	require.NoError(t, err)
+	assert.Equal(t, [7]bool{false, true, true, true, false, true, false}, s.Days)
+	assert.Equal(t, []Window{{540, 720}, {780, 1080}}, s.Windows)
+	assert.Equal(t, "alice mon,tue,wed,fri 09:00-12:00,13:00-18:00 Europe/Berlin", s.String())
+
+	s, err = Parse(nil, []string{"fri-mon"}, nil, "UTC", false)
+	require.NoError(t, err)
+	assert.Equal(t, "* sun,mon,fri,sat 00:00-24:00 UTC", s.String())
+
+	for _, days := range []string{"", "sunday", "mon-", "mon-xyz"} {
+		_, err = Parse(nil, []string{days}, nil, "UTC", false)
+		assert.Error(t, err, days)
+	}
+	for _, hours := range []string{"9-17", "09:00", "09:00-09:00", "24:00-06:00", "08:60-09:00", "09:00-24:01"} {
+		_, err = Parse(nil, nil, []string{hours}, "UTC", false)
+		assert.Error(t, err, hours)
+	}
+	_, err = Parse(nil, nil, nil, "Mars/Olympus", false)
+	assert.Error(t, err)
+}
+
+func TestActive(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	// business hours in Berlin
+	s, err := Parse(nil, []string{"mon-fri"}, []string{"09:00-18:00"}, "Europe/Berlin", false)
+	require.NoError(t, err)
+	assert.True(t, s.Active(time.Date(2026, 10, 19, 9, 0, 0, 0, berlin)))
+	assert.False(t, s.Active(time.Date(2026, 10, 19, 18, 0, 0, 0, berlin)))
+	assert.False(t, s.Active(time.Date(2026, 10, 18, 12, 0, 0, 0, berlin)))
+	// 07:30 UTC is 09:30 in Berlin summer time
+	assert.True(t, s.Active(time.Date(2026, 7, 20, 7, 30, 0, 0, time.UTC)))
+
+	// night shift from friday to saturday belongs to friday
+	s, err = Parse(nil, []string{"fri"}, []string{"22:00-06:00"}, "UTC", false)
+	require.NoError(t, err)
+	assert.True(t, s.Active(time.Date(2026, 10, 23, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, s.Active(time.Date(2026, 10, 24, 5, 59, 0, 0, time.UTC)))
+	assert.False(t, s.Active(time.Date(2026, 10, 24, 23, 0, 0, 0, time.UTC)))
+	assert.False(t, s.Active(time.Date(2026, 10, 23, 5, 0, 0, 0, time.UTC)))
+}
+
+func TestSchedules(t *testing.T) {
+	morning, err := Parse([]string{"alice", "bob"}, nil, []string{"08:00-12:00"}, "UTC", false)
+	require.NoError(t, err)
+	evening, err := Parse([]string{"alice"}, nil, []string{"18:00-20:00"}, "UTC", true)
+	require.NoError(t, err)
+	schedules := Schedules{morning, evening}
+
+	noon := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	evenings := time.Date(2026, 10, 19, 19, 0, 0, 0, time.UTC)
+
+	_, outside := schedules.Outside("alice", evenings)
+	assert.False(t, outside)
+	s, outside := schedules.Outside("bob", evenings)
+	assert.True(t, outside)
+	assert.Equal(t, morning.String(), s.String())
+	_, outside = schedules.Outside("carol", noon)
+	assert.False(t, outside)
+
+	assert.True(t, schedules.Cut("alice", noon))
+	assert.False(t, schedules.Cut("alice", evenings))
+	assert.False(t, schedules.Cut("bob", noon))
+}
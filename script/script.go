@@ -0,0 +1,392 @@
+package script
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+)
+
+// Actions of script rules
+const (
+	ActionAllow  = "allow"
+	ActionDeny   = "deny"
+	ActionParent = "parent"
+	ActionEgress = "egress"
+)
+
+// Request holds fields of proxy request available to expressions, IP is
+// empty when destination is not resolved
+type Request struct {
+	User    string
+	Client  string
+	Command string
+	FQDN    string
+	IP      string
+	Port    int
+	Time    time.Time
+}
+
+// Rule is single line of script: action, its argument and CEL expression
+type Rule struct {
+	Action string
+	// Parent is proxy URL of parent rule
+	Parent *url.URL
+	// Egress is local address of egress rule
+	Egress net.IP
+	// Text is rule as written in script with redacted parent credentials
+	Text string
+	// Source is location of rule like "rules.cel:3"
+	Source string
+
+	program cel.Program
+}
+
+// Match evaluates expression of rule with fields of req
+func (r *Rule) Match(req Request) (bool, error) {
+	out, _, err := r.program.Eval(map[string]any{
+		"user":    req.User,
+		"client":  req.Client,
+		"command": req.Command,
+		"fqdn":    req.FQDN,
+		"ip":      req.IP,
+		"port":    req.Port,
+		"time":    req.Time,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", r.Source, err)
+	}
+
+	match, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: expression returned %s", r.Source, out.Type())
+	}
+
+	return match, nil
+}
+
+// Result is outcome of script for request. Decision is first matching allow
+// or deny rule, Parent and Egress are first matching route rules before it.
+type Result struct {
+	Decision *Rule
+	Parent   *Rule
+	Egress   *Rule
+}
+
+// RefreshInterval is how often script file is checked for changes
+const RefreshInterval = 10 * time.Second
+
+// Script is rules file reloaded by Reload when its modification time changes,
+// rules failing to compile keep previous rules until file is fixed
+type Script struct {
+	Path string
+	// reloadMu serializes reloads, so changed file is compiled once
+	reloadMu sync.Mutex
+
+	mu      sync.RWMutex
+	rules   []*Rule
+	modTime time.Time
+}
+
+// Load reads and compiles rules of file at path
+func Load(path string) (*Script, error) {
+	s := &Script{Path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Script) load(modTime time.Time) error {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+	rules, err := Parse(s.Path, data)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = rules
+	s.modTime = modTime
+
+	return nil
+}
+
+// Reload compiles file again when it is changed
+func (s *Script) Reload() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return
+	}
+
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := s.load(info.ModTime()); err != nil {
+		slog.Error("Reload script", "file", s.Path, "err", err)
+
+		s.mu.Lock()
+		s.modTime = info.ModTime()
+		s.mu.Unlock()
+
+		return
+	}
+
+	slog.Info("Reload script", "file", s.Path)
+}
+
+// Refresh reloads changed script every interval until ctx is done
+func (s *Script) Refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Reload()
+		}
+	}
+}
+
+// Rules returns current rules of script, nil Script has no rules
+func (s *Script) Rules() []*Rule {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rules
+}
+
+// Evaluate runs rules in order until allow or deny rule matches. Rule which
+// fails to evaluate stops script with error.
+func (s *Script) Evaluate(req Request) (Result, error) {
+	var result Result
+	for _, rule := range s.Rules() {
+		if rule.Action == ActionParent && result.Parent != nil || rule.Action == ActionEgress && result.Egress != nil {
+			continue
+		}
+
+		match, err := rule.Match(req)
+		if err != nil {
+			return result, err
+		}
+		if !match {
+			continue
+		}
+
+		switch rule.Action {
+		case ActionParent:
+			result.Parent = rule
+		case ActionEgress:
+			result.Egress = rule
+		default:
+			result.Decision = rule
+			return result, nil
+		}
+	}
+
+	return result, nil
+}
+
+// Parse compiles rules of script, name is used in locations of rules and
+// errors. Rule is line "action expression", actions parent and egress have
+// proxy URL or local IP before expression. Lines starting with space continue
+// expression of previous rule, lines starting with # are comments.
+func Parse(name string, data []byte) ([]*Rule, error) {
+	type block struct {
+		line int
+		text string
+	}
+
+	var blocks []block
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case text[0] == ' ' || text[0] == '\t':
+			if len(blocks) == 0 {
+				return nil, fmt.Errorf("%s:%d: continuation line without rule", name, line)
+			}
+			blocks[len(blocks)-1].text += "\n" + text
+		default:
+			blocks = append(blocks, block{line: line, text: text})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var errs []error
+	rules := make([]*Rule, 0, len(blocks))
+	for _, b := range blocks {
+		rule, err := parseRule(b.text)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %w", name, b.line, err))
+			continue
+		}
+		rule.Source = fmt.Sprintf("%s:%d", name, b.line)
+		rules = append(rules, rule)
+	}
+
+	return rules, errors.Join(errs...)
+}
+
+func parseRule(text string) (*Rule, error) {
+	action, expr := cutField(text)
+	rule := &Rule{Action: action}
+
+	var arg string
+	switch action {
+	case ActionAllow, ActionDeny:
+	case ActionParent, ActionEgress:
+		arg, expr = cutField(expr)
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected allow, deny, parent or egress", action)
+	}
+
+	switch action {
+	case ActionParent:
+		parent, err := url.Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		if parent.Scheme != "socks5" && parent.Scheme != "http" || parent.Port() == "" {
+			return nil, fmt.Errorf("invalid parent proxy %q, expected socks5://host:port or http://host:port", parent.Redacted())
+		}
+		rule.Parent, arg = parent, parent.Redacted()
+	case ActionEgress:
+		if rule.Egress = net.ParseIP(arg); rule.Egress == nil {
+			return nil, fmt.Errorf("invalid egress address %q", arg)
+		}
+	}
+
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, fmt.Errorf("%s rule has no expression", action)
+	}
+	program, err := compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	rule.program = program
+
+	rule.Text = strings.Join(strings.Fields(strings.Join([]string{action, arg, expr}, " ")), " ")
+
+	return rule, nil
+}
+
+// cutField splits first whitespace separated field of text
+func cutField(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		return text[:i], text[i:]
+	}
+
+	return text, ""
+}
+
+// env declares request fields and functions of expressions
+var env = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("user", cel.StringType),
+		cel.Variable("client", cel.StringType),
+		cel.Variable("command", cel.StringType),
+		cel.Variable("fqdn", cel.StringType),
+		cel.Variable("ip", cel.StringType),
+		cel.Variable("port", cel.IntType),
+		cel.Variable("time", cel.TimestampType),
+		ext.Strings(),
+		cel.Function("inNet",
+			cel.Overload("inNet_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(inNet))),
+		cel.ASTValidators(cidrValidator{}),
+	)
+})
+
+func compile(expr string) (cel.Program, error) {
+	e, err := env()
+	if err != nil {
+		return nil, err
+	}
+
+	checked, issues := e.Compile(expr)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if checked.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression must return bool, not %s", checked.OutputType())
+	}
+
+	return e.Program(checked)
+}
+
+// inNet reports whether address is in CIDR, empty address is in no network
+func inNet(address, cidr ref.Val) ref.Val {
+	_, ipNet, err := net.ParseCIDR(string(cidr.(types.String)))
+	if err != nil {
+		return types.NewErr("inNet: %v", err)
+	}
+
+	ip := net.ParseIP(string(address.(types.String)))
+	return types.Bool(ip != nil && ipNet.Contains(ip))
+}
+
+// cidrValidator checks literal networks of inNet when script is compiled
+type cidrValidator struct{}
+
+func (cidrValidator) Name() string {
+	return "cidr"
+}
+
+func (cidrValidator) Validate(_ *cel.Env, _ cel.ValidatorConfig, a *ast.AST, issues *cel.Issues) {
+	for _, call := range ast.MatchDescendants(ast.NavigateAST(a), ast.FunctionMatcher("inNet")) {
+		args := call.AsCall().Args()
+		if len(args) != 2 || args[1].Kind() != ast.LiteralKind {
+			continue
+		}
+		if cidr, ok := args[1].AsLiteral().Value().(string); ok {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				issues.ReportErrorAtID(args[1].ID(), "invalid network %q of inNet", cidr)
+			}
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -16,19 +18,33 @@ type Stat struct {
 	readBite  uint64
 	writeBite uint64
 	auth      string
+	metrics   map[string]func() any
+	mux       *http.ServeMux
+	// routes holds handlers of endpoints registered with method by path
+	routes map[string]map[string]http.Handler
 }
 
 type responseStat struct {
-	Status    string `json:"status"`
-	ConnCount uint64 `json:"connCount"`
-	ReadBite  uint64 `json:"readBite"`
-	WriteBite uint64 `json:"writeBite"`
+	Status    string         `json:"status"`
+	ConnCount uint64         `json:"connCount"`
+	ReadBite  uint64         `json:"readBite"`
+	WriteBite uint64         `json:"writeBite"`
+	Metrics   map[string]any `json:"metrics,omitempty"`
 }
 
 func NewStat(enabled bool, address string, auth string) *Stat {
 	stat := &Stat{
-		auth: auth,
+		auth:    auth,
+		metrics: make(map[string]func() any),
+		mux:     http.NewServeMux(),
+		routes:  make(map[string]map[string]http.Handler),
 	}
+	stat.Handle("GET /status", http.HandlerFunc(stat.serveStatus))
+	stat.mux.HandleFunc("/", func(writer http.ResponseWriter, _ *http.Request) {
+		writer.WriteHeader(404)
+		_, _ = writer.Write([]byte("Host not found"))
+	})
+
 	if enabled {
 		slog.Info("Starting Status server", "address", address)
 		go stat.listenAndServe(address)
@@ -38,13 +54,112 @@ func NewStat(enabled bool, address string, auth string) *Stat {
 	return stat
 }
 
+// Handle registers additional endpoint of status server, pattern follows http.ServeMux syntax.
+// Path of pattern with method is registered without it, so other methods get
+// 405 with Allow header instead of 404 of catch-all endpoint.
+func (s *Stat) Handle(pattern string, handler http.Handler) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		s.mux.Handle(pattern, handler)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	methods, ok := s.routes[path]
+	if !ok {
+		methods = make(map[string]http.Handler)
+		s.routes[path] = methods
+		s.mux.Handle(path, s.routeHandler(path))
+	}
+	methods[method] = handler
+}
+
+// routeHandler dispatches request of path by method, HEAD is served by GET handler
+func (s *Stat) routeHandler(path string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		s.RLock()
+		methods := s.routes[path]
+		handler, ok := methods[request.Method]
+		if !ok && request.Method == http.MethodHead {
+			handler, ok = methods[http.MethodGet]
+		}
+		allowed := make([]string, 0, len(methods)+1)
+		for method := range methods {
+			allowed = append(allowed, method)
+			if method == http.MethodGet {
+				allowed = append(allowed, http.MethodHead)
+			}
+		}
+		s.RUnlock()
+
+		if !ok {
+			slices.Sort(allowed)
+			writer.Header().Set("Allow", strings.Join(allowed, ", "))
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// AddMetrics registers collector of additional metrics reported by /status under name
+func (s *Stat) AddMetrics(name string, collector func() any) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.metrics[name] = collector
+}
+
+func (s *Stat) collectMetrics() map[string]any {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.metrics) == 0 {
+		return nil
+	}
+
+	result := make(map[string]any, len(s.metrics))
+	for name, collector := range s.metrics {
+		result[name] = collector()
+	}
+
+	return result
+}
+
 func (s *Stat) Dial(ctx context.Context, network, address string) (net.Conn, error) {
-	var dialer net.Dialer
+	return s.dial(ctx, &net.Dialer{}, network, address)
+}
+
+// Dialer returns Dial binding outgoing connections to localIP, nil localIP is any address
+func (s *Stat) Dialer(localIP net.IP) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if localIP == nil {
+		return s.Dial
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: localIP}}
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: localIP}
+		}
+
+		return s.dial(ctx, dialer, network, address)
+	}
+}
+
+func (s *Stat) dial(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
 	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
 		return conn, err
 	}
 
+	return s.Track(conn), nil
+}
+
+// Track counts connection not made by Dial, like accepted by BIND, in status
+func (s *Stat) Track(conn net.Conn) net.Conn {
 	s.connOpen()
 
 	return Conn{
@@ -52,7 +167,7 @@ func (s *Stat) Dial(ctx context.Context, network, address string) (net.Conn, err
 		s.connRead,
 		s.connWrite,
 		s.connClose,
-	}, nil
+	}
 }
 
 func (s *Stat) connOpen() {
@@ -79,32 +194,33 @@ func (s *Stat) listenAndServe(address string) {
 }
 
 func (s *Stat) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	if request.Method != http.MethodGet {
-		writer.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
 	if s.auth != "" && ("Bearer "+s.auth) != request.Header.Get("Authorization") {
 		writer.WriteHeader(401)
 		return
 	}
 
-	if request.RequestURI == "/status" {
-		writer.Header().Set("Content-Type", "application/json")
-		response, err := json.Marshal(responseStat{
-			Status:    "ok",
-			ConnCount: atomic.LoadUint64(&s.connCnt),
-			ReadBite:  atomic.LoadUint64(&s.readBite),
-			WriteBite: atomic.LoadUint64(&s.writeBite),
-		})
+	// state changing endpoints like DNS cache flush require STATUS_TOKEN
+	if s.auth == "" && request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
 
-		if err == nil {
-			_, _ = writer.Write(response)
+	s.mux.ServeHTTP(writer, request)
+}
 
-			return
-		}
+func (s *Stat) serveStatus(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	response, err := json.Marshal(responseStat{
+		Status:    "ok",
+		ConnCount: atomic.LoadUint64(&s.connCnt),
+		ReadBite:  atomic.LoadUint64(&s.readBite),
+		WriteBite: atomic.LoadUint64(&s.writeBite),
+		Metrics:   s.collectMetrics(),
+	})
+	if err != nil {
+		writer.WriteHeader(500)
+		return
 	}
 
-	writer.WriteHeader(404)
-	_, _ = writer.Write([]byte("Host not found"))
+	_, _ = writer.Write(response)
 }
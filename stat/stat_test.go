@@ -0,0 +1,59 @@
+package stat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTPMethods(t *testing.T) {
+	flushed := 0
+	serve := func(s *Stat, method, token string) int {
+		s.Handle("DELETE /flush", http.HandlerFunc(func(http.ResponseWriter, *http.Request) { flushed++ }))
+		request := httptest.NewRequest(method, "/flush", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// state changing requests are refused without token
+	assert.Equal(t, http.StatusForbidden, serve(NewStat(false, "", ""), http.MethodDelete, ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(NewStat(false, "", "secret"), http.MethodDelete, ""))
+	assert.Equal(t, http.StatusOK, serve(NewStat(false, "", "secret"), http.MethodDelete, "secret"))
+	assert.Equal(t, 1, flushed)
+
+	recorder := httptest.NewRecorder()
+	NewStat(false, "", "").ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestServeHTTPMethodNotAllowed(t *testing.T) {
+	s := NewStat(false, "", "secret")
+	s.Handle("GET /cache", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	s.Handle("DELETE /cache", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := serve(http.MethodPost, "/cache")
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, "DELETE, GET, HEAD", recorder.Header().Get("Allow"))
+
+	recorder = serve(http.MethodPost, "/status")
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, "GET, HEAD", recorder.Header().Get("Allow"))
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodHead, "/status").Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/cache").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/unknown").Code)
+}